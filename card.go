@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/larksuite/oapi-sdk-go/v3/event/dispatcher/callback"
+)
+
+// Action value of the submit button of the create form
+const createVMAction = "create_vm"
+
+// card is the JSON 2.0 structure of an interactive message card
+type card map[string]interface{}
+
+func plainText(content string) card {
+	return card{"tag": "plain_text", "content": content}
+}
+
+func markdown(content string) card {
+	return card{"tag": "markdown", "content": content}
+}
+
+// selectStatic is a dropdown of a form, options are value and label pairs
+func selectStatic(name, initial string, options [][2]string) card {
+	opts := make([]card, len(options))
+	for i, o := range options {
+		opts[i] = card{"value": o[0], "text": plainText(o[1])}
+	}
+	return card{"tag": "select_static", "name": name, "initial_option": initial, "options": opts, "width": "fill"}
+}
+
+func input(name, label, placeholder string, required bool) card {
+	return card{
+		"tag":         "input",
+		"name":        name,
+		"required":    required,
+		"label":       plainText(label),
+		"placeholder": plainText(placeholder),
+		"width":       "fill",
+	}
+}
+
+// createVMCard is the form sent by /create_vm. Its dropdowns list the
+// flavors, the images and templates, and the hosts. Settings the form does
+// not cover can still be replied as text.
+func createVMCard() card {
+	defaults := DefaultVMSpec()
+	flavors := [][2]string{{"default", fmt.Sprintf("default: %d vCPU / %d MB / %d GB", defaults.NumVCPUs, defaults.Memory, defaults.DiskSize)}}
+	for _, name := range sortedKeys(Flavors) {
+		flavors = append(flavors, [2]string{name, fmt.Sprintf("%s: %s", name, Flavors[name])})
+	}
+	var sources [][2]string
+	for _, name := range Images.Names() {
+		sources = append(sources, [2]string{"image:" + name, "Image " + name})
+	}
+	if list, err := templates.List(); err == nil {
+		for _, t := range list {
+			sources = append(sources, [2]string{"template:" + t.Name, "Template " + t.Name})
+		}
+	}
+	hosts := [][2]string{{"auto", "Choose automatically"}}
+	for _, name := range Hosts.Names() {
+		hosts = append(hosts, [2]string{name, name})
+	}
+
+	form := []card{
+		input("vm_name", "Name", "VM name, also used as hostname", true),
+		markdown("**Flavor**"),
+		selectStatic("flavor", "default", flavors),
+		markdown("**Image or template**"),
+		selectStatic("source", sources[0][0], sources),
+		markdown("**Host**"),
+		selectStatic("host", "auto", hosts),
+		input("ssh_public_key", "SSH public key", "Leave empty to use the keys stored with /ssh_key", false),
+		{
+			"tag":              "button",
+			"name":             "submit",
+			"text":             plainText("Create"),
+			"type":             "primary",
+			"form_action_type": "submit",
+			"behaviors":        []card{{"type": "callback", "value": card{"action": createVMAction}}},
+		},
+	}
+	return card{
+		"schema": "2.0",
+		"config": card{"update_multi": true},
+		"header": card{"title": plainText("Create VM"), "template": "blue"},
+		"body": card{"elements": []card{
+			{"tag": "form", "name": "create_vm_form", "elements": form},
+			{
+				"tag":      "collapsible_panel",
+				"expanded": false,
+				"header":   card{"title": plainText("More settings as text")},
+				"elements": []card{markdown("Reply in this thread and @ the bot with a configuration like:\n```\n" + ExampleConfig + "```")},
+			},
+		}},
+	}
+}
+
+// submittedCard replaces the form once a configuration is accepted, so it
+// cannot be submitted twice
+func submittedCard(spec *VMSpec) card {
+	source := "Image " + spec.Image
+	if spec.Template != "" {
+		source = "Template " + spec.Template
+	}
+	host := spec.Host
+	if host == "" {
+		host = "automatic"
+	}
+	return card{
+		"schema": "2.0",
+		"header": card{"title": plainText("Create VM " + spec.VMName), "template": "green"},
+		"body":   card{"elements": []card{markdown(fmt.Sprintf("Configuration submitted\n%d vCPU / %d MB / %d GB\n%s\nHost: %s", spec.NumVCPUs, spec.Memory, spec.DiskSize, source, host))}},
+	}
+}
+
+// formConfig turns the values of the create form into the same configuration
+// keys as a text reply
+func formConfig(form map[string]interface{}) map[string]string {
+	value := func(key string) string {
+		s, _ := form[key].(string)
+		return strings.TrimSpace(s)
+	}
+	config := map[string]string{"vm_name": value("vm_name")}
+	hostnameFromVMName(config)
+	if flavor := value("flavor"); flavor != "" && flavor != "default" {
+		config["flavor"] = flavor
+	}
+	if kind, name, ok := strings.Cut(value("source"), ":"); ok {
+		config[kind] = name
+	}
+	if host := value("host"); host != "" && host != "auto" {
+		config["host"] = host
+	}
+	if key := value("ssh_public_key"); key != "" {
+		config["ssh_public_key"] = key
+	}
+	return config
+}
+
+// handleCardAction handles the submit button of the create form. The spec is
+// parsed and validated exactly like a text reply and handed to the session of
+// the card's thread. Lark expects the answer within 3 seconds, so replies in
+// the thread are sent in the background.
+func handleCardAction(ctx context.Context, event *callback.CardActionTriggerEvent) (*callback.CardActionTriggerResponse, error) {
+	if event.Event == nil || event.Event.Action == nil || event.Event.Context == nil || event.Event.Operator == nil {
+		return nil, nil
+	}
+	if action, _ := event.Event.Action.Value["action"].(string); action != createVMAction {
+		return nil, nil
+	}
+	sender := Sender{OpenID: event.Event.Operator.OpenID}
+	if event.Event.Operator.UserID != nil {
+		sender.UserID = *event.Event.Operator.UserID
+	}
+	cardID := event.Event.Context.OpenMessageID
+
+	session, ok := sessions.GetByParent(cardID)
+	if !ok {
+		return toast("error", "This form has no pending /create_vm session, please start a new one with /create_vm"), nil
+	}
+	if !session.CanOperateSender(sender) {
+		return toast("error", "Only the requester, a co-owner or an admin can submit this form"), nil
+	}
+
+	spec, err := ParseVMSpec(session.ProfileID, formConfig(event.Event.Action.FormValue))
+	if err == nil {
+		err = checkDeployable(session.UserID, spec)
+	}
+	if err != nil {
+		go func() {
+			_, err := sendReply(context.WithoutCancel(ctx), cardID, "Invalid configuration, please fix the following and submit again:\n"+err.Error(), true)
+			if err != nil {
+				fmt.Println("Failed to send reply:", err)
+			}
+		}()
+		return toast("error", "Invalid configuration, see the thread"), nil
+	}
+	if !session.Deliver(spec) {
+		return toast("warning", "A configuration has already been submitted in this thread"), nil
+	}
+	return &callback.CardActionTriggerResponse{
+		Toast: &callback.Toast{Type: "success", Content: "Configuration submitted"},
+		Card:  &callback.Card{Type: "raw", Data: submittedCard(spec)},
+	}, nil
+}
+
+func toast(kind, content string) *callback.CardActionTriggerResponse {
+	return &callback.CardActionTriggerResponse{Toast: &callback.Toast{Type: kind, Content: content}}
+}
+
+// sendCardReply replies to a message with an interactive card
+func sendCardReply(ctx context.Context, messageID string, c card, replyInThread bool) (*MessageResponse, error) {
+	content, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return replyMessage(ctx, messageID, "interactive", string(content), replyInThread)
+}
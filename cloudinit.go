@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Limits of the cloud-init snippets a spec may add
+const (
+	maxPackages      = 50
+	maxRunCmd        = 50
+	maxWriteFiles    = 20
+	maxFileContent   = 16 * 1024
+	maxCloudConfig   = 32 * 1024
+	defaultFileMode  = "0644"
+	defaultAptMirror = "https://mirrors.ustc.edu.cn/ubuntu/"
+	defaultTimezone  = "Asia/Shanghai"
+)
+
+var (
+	packagePattern    = regexp.MustCompile(`^[a-z0-9][a-z0-9+.:=~-]*$`)
+	permissionPattern = regexp.MustCompile(`^0?[0-7]{3}$`)
+)
+
+// CloudInitSnippet is a set of cloud-config modules merged into the user data
+type CloudInitSnippet struct {
+	Packages   []string    `yaml:"packages"`
+	RunCmd     []string    `yaml:"runcmd"`
+	WriteFiles []WriteFile `yaml:"write_files"`
+}
+
+// WriteFile is a write_files entry of cloud-config
+type WriteFile struct {
+	Path        string `yaml:"path"`
+	Content     string `yaml:"content"`
+	Permissions string `yaml:"permissions,omitempty"`
+}
+
+// CloudInitConfig is the operator side of the cloud-config: the timezone, the
+// APT mirror, a base snippet applied to every VM and named profiles users can
+// pick with profiles = ["docker"]
+type CloudInitConfig struct {
+	Timezone  string                       `yaml:"timezone"`
+	AptMirror string                       `yaml:"apt_mirror"`
+	Base      CloudInitSnippet             `yaml:"base"`
+	Profiles  map[string]*CloudInitSnippet `yaml:"profiles"`
+}
+
+// Global cloud-init settings, loaded in main
+var CloudInit *CloudInitConfig
+
+// DefaultCloudInitConfig returns the settings used without a cloud-init file
+func DefaultCloudInitConfig() *CloudInitConfig {
+	return &CloudInitConfig{
+		Timezone:  defaultTimezone,
+		AptMirror: defaultAptMirror,
+		Base:      CloudInitSnippet{Packages: []string{"curl", "vim", "git"}},
+	}
+}
+
+// LoadCloudInitConfig reads the cloud-init settings. Unknown keys are
+// rejected so a typo in a profile does not silently drop a module.
+func LoadCloudInitConfig(path string) (*CloudInitConfig, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return DefaultCloudInitConfig(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cloud-init file %s: %w", path, err)
+	}
+	c := &CloudInitConfig{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("failed to parse cloud-init file %s: %w", path, err)
+	}
+	errs := c.Base.validate("base.")
+	for _, name := range sortedKeys(c.Profiles) {
+		if c.Profiles[name] == nil {
+			c.Profiles[name] = &CloudInitSnippet{}
+		}
+		errs = append(errs, c.Profiles[name].validate("profiles."+name+".")...)
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid cloud-init file %s:\n%w", path, errs)
+	}
+	return c, nil
+}
+
+// ProfileNames returns the names of the profiles, sorted
+func (c *CloudInitConfig) ProfileNames() string {
+	if len(c.Profiles) == 0 {
+		return "none"
+	}
+	return strings.Join(sortedKeys(c.Profiles), ", ")
+}
+
+// cloudConfig holds the cloud-config modules rendered by Go, the users and
+// hostname are rendered by the template in cloud-init/userdata.yaml
+type cloudConfig struct {
+	Timezone      string      `yaml:"timezone,omitempty"`
+	Apt           *aptConfig  `yaml:"apt,omitempty"`
+	PackageUpdate bool        `yaml:"package_update"`
+	Packages      []string    `yaml:"packages,omitempty"`
+	WriteFiles    []WriteFile `yaml:"write_files,omitempty"`
+	RunCmd        []string    `yaml:"runcmd,omitempty"`
+}
+
+type aptConfig struct {
+	SourcesList string `yaml:"sources_list"`
+}
+
+// Render merges the base snippet, the profiles of the spec in order and the
+// snippet of the spec itself into cloud-config YAML. Packages are deduplicated,
+// runcmd lines and files keep their order. The result is parsed back to make
+// sure the document means exactly what was merged.
+func (c *CloudInitConfig) Render(spec *VMSpec) (string, error) {
+	snippets := []*CloudInitSnippet{&c.Base}
+	for _, name := range spec.CloudInitProfiles {
+		profile, ok := c.Profiles[name]
+		if !ok {
+			return "", fmt.Errorf("unknown cloud-init profile %q", name)
+		}
+		snippets = append(snippets, profile)
+	}
+	snippets = append(snippets, &CloudInitSnippet{Packages: spec.Packages, RunCmd: spec.RunCmd, WriteFiles: spec.WriteFiles})
+
+	cc := &cloudConfig{Timezone: c.Timezone, PackageUpdate: true}
+	if c.AptMirror != "" {
+		cc.Apt = &aptConfig{SourcesList: fmt.Sprintf("Types: deb\nURIs: %s\nSuites: $RELEASE\nComponents: main restricted universe multiverse\n", c.AptMirror)}
+	}
+	seen := make(map[string]bool)
+	for _, sn := range snippets {
+		for _, pkg := range sn.Packages {
+			if !seen[pkg] {
+				seen[pkg] = true
+				cc.Packages = append(cc.Packages, pkg)
+			}
+		}
+		cc.RunCmd = append(cc.RunCmd, sn.RunCmd...)
+		for _, f := range sn.WriteFiles {
+			if f.Permissions == "" {
+				f.Permissions = defaultFileMode
+			}
+			cc.WriteFiles = append(cc.WriteFiles, f)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(cc); err != nil {
+		return "", fmt.Errorf("failed to encode cloud-config: %w", err)
+	}
+	data := buf.Bytes()
+	if len(data) > maxCloudConfig {
+		return "", fmt.Errorf("cloud-config is %d bytes, at most %d are allowed", len(data), maxCloudConfig)
+	}
+	var check cloudConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&check); err != nil {
+		return "", fmt.Errorf("rendered cloud-config is not valid YAML: %w", err)
+	}
+	if !reflect.DeepEqual(&check, cc) {
+		return "", fmt.Errorf("rendered cloud-config does not round-trip")
+	}
+	return string(data), nil
+}
+
+// validate checks a snippet, the keys of the errors start with prefix
+func (sn *CloudInitSnippet) validate(prefix string) SpecErrors {
+	var errs SpecErrors
+	errs = append(errs, validatePackages(prefix+"packages", sn.Packages)...)
+	errs = append(errs, validateRunCmd(prefix+"runcmd", sn.RunCmd)...)
+	if len(sn.WriteFiles) > maxWriteFiles {
+		errs = append(errs, fmt.Sprintf("%swrite_files: at most %d files are allowed", prefix, maxWriteFiles))
+	}
+	for i := range sn.WriteFiles {
+		if err := sn.WriteFiles[i].validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("%swrite_files[%d]: %v", prefix, i, err))
+		}
+	}
+	return errs
+}
+
+func validatePackages(key string, packages []string) SpecErrors {
+	var errs SpecErrors
+	if len(packages) > maxPackages {
+		errs = append(errs, fmt.Sprintf("%s: at most %d packages are allowed", key, maxPackages))
+	}
+	for i, pkg := range packages {
+		if !packagePattern.MatchString(pkg) {
+			errs = append(errs, fmt.Sprintf("%s[%d]: %q is not a valid package name", key, i, pkg))
+		}
+	}
+	return errs
+}
+
+func validateRunCmd(key string, lines []string) SpecErrors {
+	var errs SpecErrors
+	if len(lines) > maxRunCmd {
+		errs = append(errs, fmt.Sprintf("%s: at most %d commands are allowed", key, maxRunCmd))
+	}
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			errs = append(errs, fmt.Sprintf("%s[%d]: must not be empty", key, i))
+		} else if strings.ContainsRune(line, 0) {
+			errs = append(errs, fmt.Sprintf("%s[%d]: must not contain NUL", key, i))
+		}
+	}
+	return errs
+}
+
+func (f *WriteFile) validate() error {
+	if !path.IsAbs(f.Path) || path.Clean(f.Path) != f.Path {
+		return fmt.Errorf("path %q must be a clean absolute path", f.Path)
+	}
+	if len(f.Content) > maxFileContent {
+		return fmt.Errorf("content is %d bytes, at most %d are allowed", len(f.Content), maxFileContent)
+	}
+	if f.Permissions != "" && !permissionPattern.MatchString(f.Permissions) {
+		return fmt.Errorf("permissions %q must be an octal mode like 0644", f.Permissions)
+	}
+	return nil
+}
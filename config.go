@@ -1,6 +1,11 @@
 package main
 
-import "os"
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
 
 var (
 	// AppID is the app id
@@ -8,47 +13,143 @@ var (
 	AppSecret     string
 	ExampleConfig string
 	HelpMsg       string
+	// DataDir is where the bot keeps persistent data such as the VM inventory
+	DataDir string
+	// StateDir holds one Terraform workspace per VM, named after the VM ID
+	StateDir string
+	// MaxParallelJobs is the number of Terraform deployments that may run at once
+	MaxParallelJobs int
+	// AdminUsers are the user ids allowed to manage every VM
+	AdminUsers []string
+	// HostsFile lists the ESXi hosts, see HostRegistry
+	HostsFile string
+	// PlacementPolicy chooses a host for VMs that are not pinned to one
+	PlacementPolicy string
+	// QuotaFile holds the per-user and per-group quotas, see QuotaConfig
+	QuotaFile string
+	// FlavorsFile holds the named VM sizes, see Flavor
+	FlavorsFile string
+	// TeamSSHKeysFile holds public keys authorized on every VM
+	TeamSSHKeysFile string
+	// ImagesFile is the image catalog, see Image
+	ImagesFile string
+	// TerraformBinary is the Terraform executable, "terraform" from PATH by default
+	TerraformBinary string
+	// CloudInitFile holds the timezone, APT mirror and cloud-init profiles, see CloudInitConfig
+	CloudInitFile string
 )
 
 func init() {
 	AppID = os.Getenv("APP_ID")
 	AppSecret = os.Getenv("APP_SECRET")
-    readConfig()
+	DataDir = os.Getenv("DATA_DIR")
+	if DataDir == "" {
+		DataDir = "data"
+	}
+	StateDir = os.Getenv("STATE_DIR")
+	if StateDir == "" {
+		StateDir = "state"
+	}
+	HostsFile = os.Getenv("HOSTS_FILE")
+	if HostsFile == "" {
+		HostsFile = "config/hosts.json"
+	}
+	PlacementPolicy = os.Getenv("PLACEMENT_POLICY")
+	QuotaFile = os.Getenv("QUOTA_FILE")
+	if QuotaFile == "" {
+		QuotaFile = "config/quotas.json"
+	}
+	FlavorsFile = os.Getenv("FLAVORS_FILE")
+	if FlavorsFile == "" {
+		FlavorsFile = "config/flavors.json"
+	}
+	TeamSSHKeysFile = os.Getenv("TEAM_SSH_KEYS_FILE")
+	if TeamSSHKeysFile == "" {
+		TeamSSHKeysFile = "config/team_keys"
+	}
+	ImagesFile = os.Getenv("IMAGES_FILE")
+	if ImagesFile == "" {
+		ImagesFile = "config/images.json"
+	}
+	TerraformBinary = os.Getenv("TERRAFORM_BIN")
+	if TerraformBinary == "" {
+		TerraformBinary = "terraform"
+	}
+	CloudInitFile = os.Getenv("CLOUD_INIT_FILE")
+	if CloudInitFile == "" {
+		CloudInitFile = "config/cloud-init.yaml"
+	}
+	MaxParallelJobs, _ = strconv.Atoi(os.Getenv("MAX_PARALLEL_JOBS"))
+	if MaxParallelJobs < 1 {
+		MaxParallelJobs = 2
+	}
+	for _, id := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			AdminUsers = append(AdminUsers, id)
+		}
+	}
 	HelpMsg = `一切指令都需要@Bot，例如：@Bot /create_vm
-/create_vm - 创建虚拟机，Bot 会创建一个话题并发送一个示例配置，用户可以根据示例配置修改后发送给 Bot（需要在话题内 @Bot）
-/release - 释放创建虚拟机的锁，Bot 会释放创建虚拟机的锁，用户可以重新创建虚拟机
+/create_vm - 创建虚拟机，Bot 会创建一个话题并发送一张表单卡片，选择规格、镜像或模板、主机并填写名称和公钥后点击 Create 即可；需要更多设置时也可以按卡片中的示例配置修改后在话题内 @Bot 发送；提交配置后若部署名额已满会排队并告知排队位置，Bot 会先在话题内发送部署计划（名称、CPU、内存、硬盘、镜像、主机），回复 /confirm 后才会创建。只有创建者、管理员以及 /create_vm 时 @ 的其他用户可以在话题内提交配置或 /release
+/create_vm <flavor> <name> [ssh_public_key] - 按规格快速创建虚拟机，不需要填写配置，其余字段使用默认值，未填写公钥时使用 /ssh_key 保存的公钥
+/flavors - 列出可用的虚拟机规格
+/destroy_vm <vm_name> - 销毁虚拟机，只有创建者或管理员可以销毁
+/list_vms - 列出自己创建的虚拟机，管理员可以使用 /list_vms all 列出所有虚拟机
+/quota - 查看自己的配额和已用资源，管理员可以使用 /quota <user_id> 查看其他用户
+/ssh_key add <key> | list | remove <fingerprint> - 管理保存的 SSH 公钥，创建虚拟机时未填写公钥会自动使用保存的所有公钥
+/images - 列出可用的系统镜像
+/template list - 列出可克隆的模板虚拟机，管理员可以使用 /template register <vm_name> [名称] [描述] 将已有虚拟机登记为模板（不是 Bot 创建的虚拟机需加上 host=<主机> 以及 numvcpus=、memory=、disk_size= 规格），/template remove <名称> 删除模板
+/release - 在话题内使用，结束当前等待配置的创建会话
+/confirm - 在话题内使用，确认 Bot 发出的部署计划并开始创建虚拟机，计划 10 分钟内未确认会被丢弃
+/cancel - 在话题内使用，取消 Bot 发出的部署计划
 /help - 显示帮助信息
+提交的配置会先进行校验，未知的字段、错误的类型或超出范围的值会在话题内逐行列出，修改后重新提交即可。
 配置文件解释：
-esxi_hostname  = "ip"                                     # ESXI 主机地址
-esxi_hostport  = 22
-esxi_hostssl   = 443
-esxi_username  = "root"
-esxi_password  = "password"
-
 ssh_username   = "ubuntu"                                 # SSH 用户名
-ssh_public_key = ""
+ssh_public_key = ""                                       # 为空则使用 /ssh_key 保存的公钥
+ssh_public_keys = []                                      # 额外的公钥列表，如 ["ssh-ed25519 AAAA...", "ssh-rsa AAAA..."]
+user.alice.ssh_public_keys = ["ssh-ed25519 AAAA..."]      # 可选，创建额外的用户 alice 及其公钥
+user.alice.sudo = true                                    # 可选，额外用户是否有 sudo 权限，默认 false
 hostname       = "vm"
 vm_name        = "vm"                                     # 生成的 VM 名称，要确保唯一
-numvcpus       = 2                                        # CPU 核数
-memory         = 2048                                     # 内存大小，单位 MB
-disk_size      = 10                                       # 硬盘大小，单位 GB
+numvcpus       = 2                                        # CPU 核数，1-32
+memory         = 2048                                     # 内存大小，单位 MB，512-65536
+disk_size      = 10                                       # 硬盘大小，单位 GB，1-2048
 disk_type      = "thin"                                   # 硬盘类型，thin 或 thick
-ovf_source     = "source_url"                             # 从 NAS 下载虚拟机配置
-clone_from_vm  = ""                                       # 从已有 VM 克隆，为空则不克隆
-datastore      = "datastore"                              # 存储名称，目前 sast esxi 上只有这个
-network_name   = "VM Network"                             # 网络名称，默认
+image          = "ubuntu-22.04"                           # 系统镜像，可用镜像见 /images，为空则使用默认镜像
+template       = ""                                       # 从模板虚拟机克隆，可用模板见 /template list，为空则使用 image
+host           = ""                                       # 指定 ESXi 主机，为空则自动选择
+flavor         = "small"                                  # 可选，使用规格设置 CPU、内存和硬盘，单独填写的字段优先
+profiles       = ["docker"]                               # 可选，管理员提供的 cloud-init 配置，可选 docker、k3s、python-dev 等
+packages       = ["htop"]                                 # 可选，额外安装的软件包
+runcmd         = ["echo hello > /tmp/hello"]              # 可选，首次启动时执行的命令
+file.motd.path = "/etc/motd"                              # 可选，写入文件 motd 的路径
+file.motd.content = "welcome\n"                          # 可选，文件内容，支持 \n 等转义
+file.motd.permissions = "0644"                            # 可选，文件权限，默认 0644
+ESXi 主机、端口、账号密码、存储和网络由管理员在服务端配置，不能在配置中修改。
 `
 }
 
-// readConfig reads the terraform.tfvars file to ExampleConfig variable
-func readConfig() {
-    f, err := os.Open("terraform/terraform.tfvars")
-    if err != nil {
-        return
-    }
-    defer f.Close()
+// isAdmin reports whether the user is listed in ADMIN_USERS
+func isAdmin(userID string) bool {
+	for _, id := range AdminUsers {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
 
-    buf := make([]byte, 1024)
-    n, _ := f.Read(buf)
-    ExampleConfig = string(buf[:n])
+// readConfig loads and validates the operator settings from
+// terraform/terraform.tfvars, called in main before the hosts are loaded
+func readConfig() error {
+	const path = "terraform/terraform.tfvars"
+	settings, err := loadOperatorSettings(path)
+	if err != nil {
+		return fmt.Errorf("failed to load operator settings: %w", err)
+	}
+	if err := settings.Validate(); err != nil {
+		return fmt.Errorf("invalid operator settings in %s: %w", path, err)
+	}
+	Operator = settings
+	return nil
 }
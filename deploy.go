@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Xunop/SAST-VMCreator/tfrunner"
+)
+
+const (
+	// confirmTimeout is how long a plan waits for /confirm or /cancel
+	confirmTimeout = 10 * time.Minute
+	// planFile is the saved plan in the workspace. It holds the values of all
+	// variables, the credentials included, so it only lives until the plan
+	// is applied or discarded and leftovers are removed at startup.
+	planFile = "plan.bin"
+)
+
+// Deployment is a VM planned in its workspace, waiting to be confirmed and
+// applied. It keeps the host reserved until it is applied or discarded.
+type Deployment struct {
+	VMID     string
+	Spec     *VMSpec
+	Host     *Host
+	Dir      string
+	Env      []string
+	Changes  []tfrunner.Change
+	Owner    string
+	CoOwners []string
+	ThreadID string
+
+	releaseHost func()
+	decision    chan bool
+}
+
+// planDeployment prepares the workspace of a new VM and saves the Terraform
+// plan for it, reporting the phases to progress
+func planDeployment(ctx context.Context, spec *VMSpec, progress *Progress) (d *Deployment, err error) {
+	// Check the image before spending time on Terraform
+	if spec.CloneFromVM == "" {
+		img, ok := Images.Get(spec.Image)
+		if !ok {
+			return nil, fmt.Errorf("unknown image %q", spec.Image)
+		}
+		if err := Images.Verify(img); err != nil {
+			return nil, err
+		}
+	}
+
+	// Pick the ESXi host, its resources stay reserved until the VM is in the inventory
+	host, release, err := Hosts.Place(spec)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Placing VM", spec.VMName, "on host", host.Name)
+	progress.SetPhase("Placed on host " + host.Name)
+
+	// Every VM gets its own durable workspace, keyed by a new VM ID
+	vmID := generateUUID()
+	dirPath, err := prepareWorkspace(vmID)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	d = &Deployment{VMID: vmID, Spec: spec, Host: host, Dir: dirPath, releaseHost: release, decision: make(chan bool, 1)}
+	defer func() {
+		if err != nil {
+			d.discard()
+		}
+	}()
+	fmt.Println("Running Terraform in directory:", dirPath)
+
+	// Write the terraform.tfvars file with the user's spec, the host settings,
+	// the team keys and the merged cloud-config modules
+	cloudConfig, err := CloudInit.Render(spec)
+	if err != nil {
+		return nil, err
+	}
+	vars := spec.Vars()
+	for key, value := range host.Settings().Vars() {
+		vars[key] = value
+	}
+	vars["team_ssh_keys"] = TeamSSHKeys
+	vars["cloud_config"] = cloudConfig
+	if err := writeTfVarsFile(filepath.Join(dirPath, "terraform.tfvars"), filepath.Join(dirPath, "variable.tf"), vars); err != nil {
+		return nil, err
+	}
+
+	terraformCtx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	// Credentials only reach Terraform through its environment
+	d.Env, err = terraformEnv(terraformCtx, host.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	progress.SetPhase("Initializing Terraform")
+	if err := runTerraformCommand(terraformCtx, dirPath, nil, progress.Handle, "init"); err != nil {
+		return nil, fmt.Errorf("terraform init failed: %w", err)
+	}
+	progress.SetPhase("Planning")
+	err = runTerraformCommand(terraformCtx, dirPath, d.Env, func(ev tfrunner.Event) {
+		progress.Handle(ev)
+		if ev.Type == tfrunner.EventPlannedChange && ev.Change != nil {
+			d.Changes = append(d.Changes, *ev.Change)
+		}
+	}, "plan", "-input=false", "-out="+planFile)
+	if err != nil {
+		return nil, fmt.Errorf("terraform plan failed: %w", err)
+	}
+	if err := os.Chmod(filepath.Join(dirPath, planFile), 0600); err != nil {
+		return nil, fmt.Errorf("failed to protect plan file: %w", err)
+	}
+	return d, nil
+}
+
+// Summary describes the planned VM and resources for the thread
+func (d *Deployment) Summary() string {
+	s := d.Spec
+	var b strings.Builder
+	fmt.Fprintf(&b, "Plan for VM %s:\n", s.VMName)
+	fmt.Fprintf(&b, "CPU: %d vCPU\nMemory: %d MB\nDisk: %d GB (%s)\n", s.NumVCPUs, s.Memory, s.DiskSize, s.DiskType)
+	if s.Template != "" {
+		fmt.Fprintf(&b, "Template: %s\n", s.Template)
+	} else {
+		fmt.Fprintf(&b, "Image: %s\n", s.Image)
+	}
+	fmt.Fprintf(&b, "Host: %s\n", d.Host.Name)
+	if len(d.Changes) > 0 {
+		b.WriteString("Resources:\n")
+		for _, c := range d.Changes {
+			fmt.Fprintf(&b, "  %s %s\n", c.Action, c.Resource.Addr)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// CanOperate reports whether the user may confirm or cancel the deployment
+func (d *Deployment) CanOperate(userID string) bool {
+	if userID == "" {
+		return false
+	}
+	if userID == d.Owner || isAdmin(userID) {
+		return true
+	}
+	for _, id := range d.CoOwners {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// apply applies the saved plan exactly as previewed and records the VM. The
+// plan file is removed whatever the outcome.
+func (d *Deployment) apply(ctx context.Context, progress *Progress) ([]string, error) {
+	planPath := filepath.Join(d.Dir, planFile)
+	defer os.Remove(planPath)
+
+	terraformCtx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+	progress.SetPhase("Applying the plan")
+	if err := runTerraformCommand(terraformCtx, d.Dir, d.Env, progress.Handle, "apply", "-input=false", planFile); err != nil {
+		return nil, fmt.Errorf("terraform apply failed: %w", err)
+	}
+
+	progress.SetPhase("Reading IP addresses")
+	ips, err := getTerraformOutputIPs(terraformCtx, d.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve Terraform outputs: %w", err)
+	}
+	if err := d.record(ips, ""); err != nil {
+		return nil, fmt.Errorf("VM created with IP addresses %s but not recorded in the inventory: %w", strings.Join(ips, ", "), err)
+	}
+	return ips, nil
+}
+
+// record adds the VM to the inventory with the given status
+func (d *Deployment) record(ips []string, status string) error {
+	return inventory.Add(&VMRecord{
+		ID:        d.VMID,
+		Name:      d.Spec.VMName,
+		Hostname:  d.Spec.Hostname,
+		Owner:     d.Owner,
+		ThreadID:  d.ThreadID,
+		NumVCPUs:  d.Spec.NumVCPUs,
+		Memory:    d.Spec.Memory,
+		DiskSize:  d.Spec.DiskSize,
+		DiskType:  d.Spec.DiskType,
+		Host:      d.Host.Name,
+		Image:     d.Spec.Image,
+		Template:  d.Spec.Template,
+		IPs:       ips,
+		CreatedAt: time.Now(),
+		Workspace: d.Dir,
+		Status:    status,
+	})
+}
+
+// discard drops the plan and the workspace and releases the host. If the
+// state already tracks resources the workspace is kept and the VM is
+// recorded as failed, so it can still be found and destroyed.
+func (d *Deployment) discard() {
+	if err := os.Remove(filepath.Join(d.Dir, planFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Failed to remove plan file:", err)
+	}
+	if err := removeWorkspace(d.Dir); err != nil {
+		fmt.Println("Failed to clean up workspace:", err)
+		if managed, stateErr := hasManagedResources(d.Dir); managed || stateErr != nil {
+			if err := d.record(nil, VMStatusFailed); err != nil {
+				fmt.Println("Failed to record failed VM, workspace", d.Dir, "must be cleaned up by hand:", err)
+			}
+		}
+	}
+	d.release()
+}
+
+// release gives the host reservation back, the VM is either in the
+// inventory or gone by then
+func (d *Deployment) release() {
+	if d.releaseHost != nil {
+		d.releaseHost()
+		d.releaseHost = nil
+	}
+}
+
+// Decide confirms or cancels a deployment taken from the registry
+func (d *Deployment) Decide(confirm bool) {
+	d.decision <- confirm
+}
+
+// DeploymentRegistry tracks the deployments waiting for confirmation, keyed
+// by thread ID
+type DeploymentRegistry struct {
+	lock        sync.Mutex
+	deployments map[string]*Deployment
+}
+
+var deployments = &DeploymentRegistry{deployments: make(map[string]*Deployment)}
+
+func (r *DeploymentRegistry) Register(d *Deployment) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.deployments[d.ThreadID] = d
+}
+
+func (r *DeploymentRegistry) Get(threadID string) (*Deployment, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	d, ok := r.deployments[threadID]
+	return d, ok
+}
+
+// Take removes d from the registry, it returns false if it was already
+// taken, so every deployment is decided exactly once
+func (r *DeploymentRegistry) Take(d *Deployment) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.deployments[d.ThreadID] != d {
+		return false
+	}
+	delete(r.deployments, d.ThreadID)
+	return true
+}
+
+// awaitConfirmation waits for /confirm or /cancel without holding a
+// deployment slot. It returns true if the deployment was confirmed, an
+// expired deployment counts as cancelled.
+func (d *Deployment) awaitConfirmation(ctx context.Context) (confirmed bool, expired bool) {
+	timer := time.NewTimer(confirmTimeout)
+	defer timer.Stop()
+	select {
+	case confirm := <-d.decision:
+		return confirm, false
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+	if !deployments.Take(d) {
+		// Decided just in time
+		return <-d.decision, false
+	}
+	return false, true
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Flavor is a named VM size defined by the operator
+type Flavor struct {
+	NumVCPUs    int    `json:"numvcpus"`
+	Memory      int    `json:"memory"`    // MB
+	DiskSize    int    `json:"disk_size"` // GB
+	Description string `json:"description"`
+}
+
+// Global flavors by name, loaded in main
+var Flavors map[string]*Flavor
+
+// LoadFlavors reads the flavors file, without it there are no flavors
+func LoadFlavors(path string) (map[string]*Flavor, error) {
+	flavors := make(map[string]*Flavor)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return flavors, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read flavors file %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &flavors); err != nil {
+		return nil, fmt.Errorf("failed to parse flavors file %s: %w", path, err)
+	}
+	return flavors, nil
+}
+
+// Apply sets the size of the spec to the flavor's
+func (f *Flavor) Apply(spec *VMSpec) {
+	spec.NumVCPUs = f.NumVCPUs
+	spec.Memory = f.Memory
+	spec.DiskSize = f.DiskSize
+}
+
+func (f *Flavor) String() string {
+	s := fmt.Sprintf("%d vCPU / %d MB / %d GB", f.NumVCPUs, f.Memory, f.DiskSize)
+	if f.Description != "" {
+		s += " - " + f.Description
+	}
+	return s
+}
+
+// flavorNames returns the names of all flavors, sorted
+func flavorNames() string {
+	return strings.Join(sortedKeys(Flavors), ", ")
+}
+
+// formatFlavors lists the flavors, one per line
+func formatFlavors() string {
+	if len(Flavors) == 0 {
+		return "No flavors configured"
+	}
+	var b strings.Builder
+	for _, name := range sortedKeys(Flavors) {
+		fmt.Fprintf(&b, "%s: %s\n", name, Flavors[name])
+	}
+	return b.String()
+}
@@ -5,6 +5,7 @@ go 1.23.2
 require (
 	github.com/google/uuid v1.6.0
 	github.com/larksuite/oapi-sdk-go/v3 v3.3.7
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
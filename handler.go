@@ -1,26 +1,25 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/Xunop/SAST-VMCreator/tfrunner"
 	"github.com/google/uuid"
 	lark "github.com/larksuite/oapi-sdk-go/v3"
 	larkim "github.com/larksuite/oapi-sdk-go/v3/service/im/v1"
 )
 
-var configChan = make(chan map[string]string, 1)
-
 func processCommands(ctx context.Context, q *CommandQueue) {
 	for {
 		cmd := q.Dequeue()
@@ -39,31 +38,367 @@ func handleCommand(ctx context.Context, cmd Command) {
 	case "/help":
 		handleHelp(ctx, cmd)
 	case "/release":
-	    handleRelease(ctx, cmd)
+		handleRelease(ctx, cmd)
+	case "/destroy_vm":
+		handleDestroyVM(ctx, cmd)
+	case "/list_vms":
+		handleListVMs(ctx, cmd)
+	case "/quota":
+		handleQuota(ctx, cmd)
+	case "/flavors":
+		handleFlavors(ctx, cmd)
+	case "/ssh_key":
+		handleSSHKey(ctx, cmd)
+	case "/images":
+		handleImages(ctx, cmd)
+	case "/template":
+		handleTemplate(ctx, cmd)
+	case "/confirm":
+		handlePlanDecision(ctx, cmd, true)
+	case "/cancel":
+		handlePlanDecision(ctx, cmd, false)
 	}
 }
 
 func handleRelease(ctx context.Context, cmd Command) {
-	messageID, ok := activeTopics.Load("current_message_id")
-	if !ok {
-		fmt.Println("Failed to get message_id from context")
+	session, ok := sessions.Get(cmd.Event.Message.ThreadID)
+	if cmd.Event.Message.ThreadID == "" || !ok {
+		_, err := sendReply(ctx, cmd.Event.Message.MessageID, fmt.Sprintf("<at user_id=\"%s\">%s</at> Please release the session by replying to the at bot /release command within its thread!", cmd.Event.Sender.UserID, cmd.Event.Sender.UserID), false)
+		if err != nil {
+			fmt.Println("Failed to send reply:", err)
+		}
 		return
 	}
-	threadID, ok := activeTopics.Load("current_thread_id")
-	if !ok {
-		fmt.Println("Failed to get thread_id from context")
+	if !session.CanOperate(cmd.Event.Sender.UserID) {
+		replyNotSessionOwner(ctx, cmd.Event, session)
+		return
+	}
+	if !session.Cancel() {
+		sendReply(ctx, cmd.Event.Message.MessageID, "The configuration has already been submitted, the session can no longer be released", false)
+		return
+	}
+	sendReply(ctx, cmd.Event.Message.MessageID, "Session released", false)
+}
+
+// VM names currently being destroyed, to reject duplicate requests
+var destroyingVMs sync.Map
+
+func handleDestroyVM(ctx context.Context, cmd Command) {
+	messageID := cmd.Event.Message.MessageID
+	userID := cmd.Event.Sender.UserID
+	if len(cmd.Args) != 1 {
+		sendReply(ctx, messageID, "Usage: /destroy_vm <vm_name>", true)
+		return
+	}
+	vmName := cmd.Args[0]
+
+	rec, err := inventory.GetByName(vmName)
+	if err != nil {
+		sendReply(ctx, messageID, fmt.Sprintf("VM %s not found", vmName), true)
+		return
+	}
+	if rec.Owner != userID && !isAdmin(userID) {
+		sendReply(ctx, messageID, fmt.Sprintf("<at user_id=\"%s\">%s</at> Only the requester of VM %s or an admin can destroy it", userID, userID, vmName), true)
+		return
+	}
+	if tpl, err := templates.GetByVMName(vmName); err == nil {
+		sendReply(ctx, messageID, fmt.Sprintf("VM %s is the golden VM of template %s, remove the template with /template remove %s first", vmName, tpl.Name, tpl.Name), true)
+		return
+	}
+	if _, busy := destroyingVMs.LoadOrStore(vmName, struct{}{}); busy {
+		sendReply(ctx, messageID, fmt.Sprintf("VM %s is already being destroyed", vmName), true)
 		return
 	}
-	curThreadID := cmd.Event.Message.ThreadID
-	if threadID.(string) != curThreadID {
-		_, err := sendReply(ctx, messageID.(string), fmt.Sprintf("<at user_id=\"%s\">%s</at> Please release the lock by replying to the at bot /release command within this thread!", cmd.Event.Sender.UserID, cmd.Event.Sender.UserID), true)
+
+	// Destroys share the deployment slots, Terraform runs against the same hosts
+	job := &Job{
+		ID: messageID,
+		Run: func(context.Context) {
+			defer destroyingVMs.Delete(vmName)
+			destroyVM(ctx, messageID, userID, rec)
+		},
+	}
+	if pos := scheduler.Submit(ctx, job); pos > 0 {
+		_, err := sendReply(ctx, messageID, fmt.Sprintf("<at user_id=\"%s\">%s</at> All deployment slots are busy, the destroy of VM %s is queued at position %d", userID, userID, vmName, pos), true)
 		if err != nil {
 			fmt.Println("Failed to send reply:", err)
 		}
+	}
+}
+
+// destroyVM runs terraform destroy in the workspace of rec and removes the
+// VM from the inventory, reporting to the thread of messageID
+func destroyVM(ctx context.Context, messageID, userID string, rec *VMRecord) {
+	vmName := rec.Name
+	progress := NewProgress(ctx, messageID, fmt.Sprintf("Destroying VM %s", vmName))
+
+	terraformCtx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+	host, ok := Hosts.Get(rec.Host)
+	if !ok {
+		progress.Finish("Failed")
+		sendReply(ctx, messageID, fmt.Sprintf("Host %s of VM %s is no longer configured, please ask an admin", rec.Host, vmName), true)
+		return
+	}
+	env, err := terraformEnv(terraformCtx, host.Credentials)
+	if err == nil {
+		err = runTerraformCommand(terraformCtx, rec.Workspace, env, progress.Handle, "destroy", "-auto-approve")
+	}
+	if err != nil {
+		fmt.Println("Failed to destroy VM:", err)
+		progress.Finish("Failed")
+		replyFailure(ctx, messageID, fmt.Sprintf("<at user_id=\"%s\">%s</at> Failed to destroy VM %s", userID, userID, vmName), err)
+		return
+	}
+
+	if err := inventory.Delete(rec.ID); err != nil {
+		fmt.Println("Failed to remove VM from inventory:", err)
+	}
+	if err := removeWorkspace(rec.Workspace); err != nil {
+		fmt.Println("Failed to remove workspace:", err)
+	}
+	progress.Finish("Done")
+	_, err = sendReply(ctx, messageID, fmt.Sprintf("<at user_id=\"%s\">%s</at> VM %s successfully destroyed!", userID, userID, vmName), true)
+	if err != nil {
+		fmt.Println("Failed to send success message:", err)
+	}
+}
+
+func handleListVMs(ctx context.Context, cmd Command) {
+	messageID := cmd.Event.Message.MessageID
+	userID := cmd.Event.Sender.UserID
+
+	var records []*VMRecord
+	var err error
+	if len(cmd.Args) > 0 && cmd.Args[0] == "all" {
+		if !isAdmin(userID) {
+			sendReply(ctx, messageID, fmt.Sprintf("<at user_id=\"%s\">%s</at> Only admins can list all VMs", userID, userID), false)
+			return
+		}
+		records, err = inventory.List()
+	} else {
+		records, err = inventory.ListByOwner(userID)
+	}
+	if err != nil {
+		fmt.Println("Failed to list VMs:", err)
+		sendReply(ctx, messageID, "Failed to list VMs. Please try again.", false)
+		return
+	}
+
+	_, err = sendReply(ctx, messageID, formatVMList(records, time.Now()), false)
+	if err != nil {
+		fmt.Println("Failed to send reply:", err)
+	}
+}
+
+// formatVMList renders VM records one VM per line. Lark shows text in a
+// proportional font, so the fields are separated instead of aligned.
+func formatVMList(records []*VMRecord, now time.Time) string {
+	if len(records) == 0 {
+		return "No VMs found"
+	}
+
+	lines := make([]string, len(records))
+	for i, rec := range records {
+		name := rec.Name
+		if rec.Status != "" {
+			name += " [" + rec.Status + "]"
+		}
+		ips := strings.Join(rec.IPs, ", ")
+		if ips == "" {
+			ips = "no IP"
+		}
+		lines[i] = fmt.Sprintf("%s | %s | %d vCPU / %d MB / %d GB | host %s | owner %s | %s ago",
+			name, ips, rec.NumVCPUs, rec.Memory, rec.DiskSize, rec.Host, rec.Owner, formatAge(now.Sub(rec.CreatedAt)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatAge renders a duration in its largest whole unit, e.g. 3d, 5h or 12m
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+}
+
+func handleQuota(ctx context.Context, cmd Command) {
+	messageID := cmd.Event.Message.MessageID
+	userID := cmd.Event.Sender.UserID
+	// Admins may look at the quota of another user
+	if len(cmd.Args) > 0 {
+		if !isAdmin(userID) {
+			sendReply(ctx, messageID, fmt.Sprintf("<at user_id=\"%s\">%s</at> Only admins can view the quota of other users", userID, userID), false)
+			return
+		}
+		userID = cmd.Args[0]
+	}
+
+	report, err := Quotas.Report(userID)
+	if err != nil {
+		fmt.Println("Failed to compute quota:", err)
+		sendReply(ctx, messageID, "Failed to get quota. Please try again.", false)
+		return
+	}
+	_, err = sendReply(ctx, messageID, report, false)
+	if err != nil {
+		fmt.Println("Failed to send reply:", err)
+	}
+}
+
+func handleFlavors(ctx context.Context, cmd Command) {
+	_, err := sendReply(ctx, cmd.Event.Message.MessageID, formatFlavors(), false)
+	if err != nil {
+		fmt.Println("Failed to send reply:", err)
+	}
+}
+
+// handleSSHKey manages the SSH keys stored in the sender's profile:
+// `/ssh_key add <key>`, `/ssh_key list` and `/ssh_key remove <fingerprint>`
+func handleSSHKey(ctx context.Context, cmd Command) {
+	messageID := cmd.Event.Message.MessageID
+	id := profileID(cmd.Event.Sender)
+	usage := "Usage: /ssh_key add <key> | /ssh_key list | /ssh_key remove <fingerprint>"
+	if len(cmd.Args) == 0 {
+		sendReply(ctx, messageID, usage, false)
+		return
+	}
+
+	var reply string
+	switch cmd.Args[0] {
+	case "add":
+		key, err := profiles.AddSSHKey(id, strings.Join(cmd.Args[1:], " "))
+		if err != nil {
+			reply = fmt.Sprintf("Failed to add SSH key: %v", err)
+			break
+		}
+		reply = fmt.Sprintf("SSH key added: %s", key.Fingerprint)
+	case "list":
+		profile, err := profiles.Get(id)
+		if err != nil {
+			fmt.Println("Failed to load profile:", err)
+			reply = "Failed to list SSH keys. Please try again."
+			break
+		}
+		if len(profile.SSHKeys) == 0 {
+			reply = "No SSH keys stored, add one with /ssh_key add <key>"
+			break
+		}
+		lines := make([]string, len(profile.SSHKeys))
+		for i, k := range profile.SSHKeys {
+			lines[i] = fmt.Sprintf("%s %s %s", k.Fingerprint, strings.Fields(k.Key)[0], sshKeyComment(k.Key))
+		}
+		reply = strings.Join(lines, "\n")
+	case "remove":
+		if len(cmd.Args) != 2 {
+			reply = usage
+			break
+		}
+		if err := profiles.RemoveSSHKey(id, cmd.Args[1]); err != nil {
+			reply = fmt.Sprintf("Failed to remove SSH key: %v", err)
+			break
+		}
+		reply = fmt.Sprintf("SSH key removed: %s", cmd.Args[1])
+	default:
+		reply = usage
+	}
+
+	_, err := sendReply(ctx, messageID, reply, false)
+	if err != nil {
+		fmt.Println("Failed to send reply:", err)
+	}
+}
+
+// sshKeyComment returns the comment of a public key, if any
+func sshKeyComment(key string) string {
+	parts := strings.Fields(key)
+	if len(parts) < 3 {
+		return ""
+	}
+	return strings.Join(parts[2:], " ")
+}
+
+func handleImages(ctx context.Context, cmd Command) {
+	_, err := sendReply(ctx, cmd.Event.Message.MessageID, Images.Format(), false)
+	if err != nil {
+		fmt.Println("Failed to send reply:", err)
+	}
+}
+
+// handleTemplate manages the golden VM catalog: `/template list`, and for
+// admins `/template register <vm_name> [name] [description]` and
+// `/template remove <name>`
+func handleTemplate(ctx context.Context, cmd Command) {
+	messageID := cmd.Event.Message.MessageID
+	userID := cmd.Event.Sender.UserID
+	usage := "Usage: /template list | /template register <vm_name> [host=<host>] [numvcpus=<n>] [memory=<MB>] [disk_size=<GB>] [name] [description] | /template remove <name>\nhost and the specs are required for VMs the bot did not create"
+	if len(cmd.Args) == 0 {
+		sendReply(ctx, messageID, usage, false)
 		return
 	}
-	terraformMutex.Unlock()
-	sendReply(ctx, cmd.Event.Message.MessageID, "Lock released", false)
+
+	var reply string
+	switch cmd.Args[0] {
+	case "list":
+		list, err := templates.List()
+		if err != nil {
+			fmt.Println("Failed to list templates:", err)
+			reply = "Failed to list templates. Please try again."
+			break
+		}
+		if len(list) == 0 {
+			reply = "No templates registered"
+			break
+		}
+		lines := make([]string, len(list))
+		for i, t := range list {
+			lines[i] = t.String()
+		}
+		reply = strings.Join(lines, "\n")
+	case "register":
+		if !isAdmin(userID) {
+			reply = "Only admins can register templates"
+			break
+		}
+		if len(cmd.Args) < 2 {
+			reply = usage
+			break
+		}
+		tpl, err := newTemplate(cmd.Args[1], cmd.Args[2:], userID)
+		if err == nil {
+			err = templates.Add(tpl)
+		}
+		if err != nil {
+			reply = fmt.Sprintf("Failed to register template: %v", err)
+			break
+		}
+		reply = fmt.Sprintf("Template registered: %s", tpl)
+	case "remove":
+		if !isAdmin(userID) {
+			reply = "Only admins can remove templates"
+			break
+		}
+		if len(cmd.Args) != 2 {
+			reply = usage
+			break
+		}
+		if err := templates.Remove(cmd.Args[1]); err != nil {
+			reply = fmt.Sprintf("Failed to remove template: %v", err)
+			break
+		}
+		reply = fmt.Sprintf("Template removed: %s", cmd.Args[1])
+	default:
+		reply = usage
+	}
+
+	_, err := sendReply(ctx, messageID, reply, false)
+	if err != nil {
+		fmt.Println("Failed to send reply:", err)
+	}
 }
 
 func handleHelp(ctx context.Context, cmd Command) {
@@ -73,97 +408,312 @@ func handleHelp(ctx context.Context, cmd Command) {
 	}
 }
 
-// Global mutex to ensure only one Terraform deployment runs at a time
-var terraformMutex sync.Mutex
-
+// handleCreateVM collects the configuration in a thread, then queues the
+// deployment. Collecting holds no deployment slot, only terraform does.
 func handleCreateVM(ctx context.Context, cmd Command) {
-	if !terraformMutex.TryLock() {
-		_, err := sendReply(ctx, cmd.Event.Message.MessageID, "another Terraform deployment is running", false)
-		if err != nil {
-			fmt.Println("Failed to send reply:", err)
-		}
+	// `/create_vm <flavor> <name>` skips the configuration round-trip
+	if len(cmd.Args) > 0 {
+		handleQuickCreateVM(ctx, cmd)
 		return
 	}
-	msgRsp, err := sendReply(ctx, cmd.Event.Message.MessageID, ExampleConfig, true)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The form card starts the thread, a text configuration replied in the thread works as well
+	msgRsp, err := sendCardReply(ctx, cmd.Event.Message.MessageID, createVMCard(), true)
 	if err != nil {
 		fmt.Println("Failed to send reply:", err)
-		terraformMutex.Unlock() // Release lock if reply fails
 		return
 	}
 
-	// Store topic information
-	activeTopics.Store(msgRsp.ThreadID, &TopicInfo{
-		UserID:   cmd.Event.Sender.UserID,
-		RootID:   cmd.Event.Message.MessageID,
-		ParentID: msgRsp.MessageID, // Parent ID is the message where the example config is sent
-		ThreadID: msgRsp.ThreadID,
-	})
+	// Users mentioned in the `/create_vm` message become co-owners of the session
+	var coOwners []string
+	for _, id := range cmd.Event.Message.MentionUserIDs {
+		if id != cmd.Event.Sender.UserID {
+			coOwners = append(coOwners, id)
+		}
+	}
+	// Register the session of this thread, the parent is the form card
+	session := NewSession(cmd.Event.Sender, cmd.Event.Message.MessageID, msgRsp.MessageID, msgRsp.ThreadID, coOwners, cancel)
+	sessions.Register(session)
+	defer sessions.Remove(msgRsp.ThreadID)
 	// Store current topic thread id in context
 	ctx = context.WithValue(ctx, "thread_id", msgRsp.ThreadID)
 	ctx = context.WithValue(ctx, "message_id", msgRsp.MessageID)
-	activeTopics.Store("current_message_id", msgRsp.MessageID)
-	activeTopics.Store("current_thread_id", msgRsp.ThreadID)
+	ctx = context.WithValue(ctx, "user_id", cmd.Event.Sender.UserID)
 
 	select {
 	case <-time.After(5 * time.Minute):
-		// Remove the topic if no reply is received within 5 minutes
-		activeTopics.Delete(msgRsp.ThreadID)
-		terraformMutex.Unlock()
+		if !session.Cancel() {
+			// The configuration arrived just in time
+			deployVM(context.WithoutCancel(ctx), cmd, msgRsp.MessageID, <-session.Configs())
+			return
+		}
 		_, err := sendReply(ctx, msgRsp.MessageID, "Configuration timeout. Please try again.", true)
 		if err != nil {
 			fmt.Println("Failed to send timeout message:", err)
-			terraformMutex.Unlock() // Release lock if reply fails
-			return
 		}
 		return
-	case userConf := <-configChan:
-		err := applyTerraformConfig(ctx, userConf)
-		// If an error occurs, send a failure message
+	case <-ctx.Done():
+		// Released by /release
+		return
+	case userConf := <-session.Configs():
+		deployVM(context.WithoutCancel(ctx), cmd, msgRsp.MessageID, userConf)
+	}
+}
+
+// handleQuickCreateVM creates a VM of a flavor with the defaults for
+// everything else: `/create_vm <flavor> <name> [ssh_public_key]`
+func handleQuickCreateVM(ctx context.Context, cmd Command) {
+	messageID := cmd.Event.Message.MessageID
+	if len(cmd.Args) < 2 {
+		sendReply(ctx, messageID, "Usage: /create_vm <flavor> <name> [ssh_public_key]\nFlavors:\n"+formatFlavors(), false)
+		return
+	}
+
+	config := map[string]string{"flavor": cmd.Args[0], "vm_name": cmd.Args[1]}
+	hostnameFromVMName(config)
+	if len(cmd.Args) > 2 {
+		config["ssh_public_key"] = strings.Join(cmd.Args[2:], " ")
+	}
+	spec, err := ParseVMSpec(profileID(cmd.Event.Sender), config)
+	if err != nil {
+		sendReply(ctx, messageID, "Invalid request:\n"+err.Error(), false)
+		return
+	}
+
+	msgRsp, err := sendReply(ctx, messageID, fmt.Sprintf("Creating VM %s with flavor %s (%s)", spec.VMName, cmd.Args[0], Flavors[cmd.Args[0]]), true)
+	if err != nil {
+		fmt.Println("Failed to send reply:", err)
+		return
+	}
+	ctx = context.WithValue(ctx, "thread_id", msgRsp.ThreadID)
+	ctx = context.WithValue(ctx, "message_id", msgRsp.MessageID)
+	ctx = context.WithValue(ctx, "user_id", cmd.Event.Sender.UserID)
+	deployVM(ctx, cmd, msgRsp.MessageID, spec)
+}
+
+// VM names of the deployments being planned, confirmed or applied, so two
+// requests cannot create VMs with the same vm_name
+var creatingVMs sync.Map
+
+// checkVMName rejects a vm_name that is in the inventory or being created,
+// vm_name identifies the VM in /destroy_vm and /template
+func checkVMName(name string) error {
+	_, err := inventory.GetByName(name)
+	switch {
+	case err == nil:
+		return fmt.Errorf("a VM named %s already exists", name)
+	case !errors.Is(err, ErrVMNotFound):
+		return err
+	}
+	if _, busy := creatingVMs.Load(name); busy {
+		return fmt.Errorf("a VM named %s is already being created", name)
+	}
+	return nil
+}
+
+// checkDeployable runs the name and quota checks of deployVM before a
+// session accepts a spec, so the requester can fix the configuration and
+// submit again. deployVM repeats them when it reserves.
+func checkDeployable(userID string, spec *VMSpec) error {
+	if err := checkVMName(spec.VMName); err != nil {
+		return err
+	}
+	return Quotas.Check(userID, spec)
+}
+
+// deployVM queues the Terraform plan of a collected configuration, posts the
+// plan to the thread of messageID and, once the requester replies /confirm,
+// queues the apply of exactly that plan
+func deployVM(ctx context.Context, cmd Command, messageID string, spec *VMSpec) {
+	userID := cmd.Event.Sender.UserID
+	threadID, _ := ctx.Value("thread_id").(string)
+	// The checks ran before the spec was accepted, they are repeated here
+	// while reserving in case another request took the name or the quota since
+	err := checkVMName(spec.VMName)
+	if err == nil {
+		if _, busy := creatingVMs.LoadOrStore(spec.VMName, struct{}{}); busy {
+			err = fmt.Errorf("a VM named %s is already being created", spec.VMName)
+		}
+	}
+	if err != nil {
+		_, err := sendReply(ctx, messageID, fmt.Sprintf("<at user_id=\"%s\">%s</at> Cannot create VM %s, %v", userID, userID, spec.VMName, err), true)
 		if err != nil {
-			fmt.Println("Failed to apply Terraform configuration:", err)
-			terraformMutex.Unlock() // Ensure the mutex is released in case of error
-			sendReply(ctx, msgRsp.MessageID, "Failed to create VM. Please try again.", true)
-			return
+			fmt.Println("Failed to send reply:", err)
 		}
-		// If the configuration is successfully applied, remove the topic
-		activeTopics.Delete(msgRsp.ThreadID)
-		terraformMutex.Unlock()
-		_, err = sendReply(ctx, msgRsp.MessageID, fmt.Sprintf("<at user_id=\"%s\">%s</at> VM successfully created!", cmd.Event.Sender.UserID, cmd.Event.Sender.UserID), true)
-		// _, err = sendReply(ctx, msgRsp.MessageID, "VM successfully created!", true)
+		return
+	}
+	// Quotas are checked before queueing, the resources stay reserved until the VM is created or dropped
+	releaseQuota, err := Quotas.Reserve(userID, spec)
+	if err != nil {
+		creatingVMs.Delete(spec.VMName)
+		_, err := sendReply(ctx, messageID, fmt.Sprintf("<at user_id=\"%s\">%s</at> Cannot create VM %s, %v", userID, userID, spec.VMName, err), true)
 		if err != nil {
-			fmt.Println("Failed to send success message:", err)
-			return
+			fmt.Println("Failed to send reply:", err)
+		}
+		return
+	}
+	// The name is held until the VM is in the inventory or dropped
+	release := func() {
+		releaseQuota()
+		creatingVMs.Delete(spec.VMName)
+	}
+	// Co-owners of the create session may confirm the plan too
+	var coOwners []string
+	if session, ok := sessions.Get(threadID); ok {
+		coOwners = session.CoOwners
+	}
+
+	job := &Job{
+		ID: messageID,
+		Run: func(context.Context) {
+			progress := NewProgress(ctx, messageID, fmt.Sprintf("Planning VM %s", spec.VMName))
+			d, err := planDeployment(ctx, spec, progress)
+			if err != nil {
+				release()
+				fmt.Println("Failed to plan Terraform configuration:", err)
+				progress.Finish("Failed")
+				replyFailure(ctx, messageID, fmt.Sprintf("<at user_id=\"%s\">%s</at> Failed to plan VM %s", userID, userID, spec.VMName), err)
+				return
+			}
+			progress.Finish("Planned")
+			d.Owner, d.CoOwners, d.ThreadID = userID, coOwners, threadID
+			deployments.Register(d)
+			_, err = sendReply(ctx, messageID, fmt.Sprintf("<at user_id=\"%s\">%s</at> %s\nReply /confirm within %s to create the VM, or /cancel", userID, userID, d.Summary(), confirmTimeout), true)
+			if err != nil {
+				fmt.Println("Failed to send plan:", err)
+			}
+			// Wait for the decision outside the deployment slot
+			go confirmDeployment(ctx, messageID, d, release)
+		},
+	}
+	if pos := scheduler.Submit(ctx, job); pos > 0 {
+		_, err := sendReply(ctx, messageID, fmt.Sprintf("<at user_id=\"%s\">%s</at> All deployment slots are busy, your deployment is queued at position %d", userID, userID, pos), true)
+		if err != nil {
+			fmt.Println("Failed to send reply:", err)
+		}
+	}
+}
+
+// confirmDeployment applies a planned deployment once confirmed, and drops
+// it when cancelled or expired. release gives the quota and the name back.
+func confirmDeployment(ctx context.Context, messageID string, d *Deployment, release func()) {
+	userID := d.Owner
+	confirmed, expired := d.awaitConfirmation(ctx)
+	if !confirmed {
+		d.discard()
+		release()
+		reply := fmt.Sprintf("Deployment of VM %s cancelled", d.Spec.VMName)
+		if expired {
+			reply = fmt.Sprintf("<at user_id=\"%s\">%s</at> The plan of VM %s was not confirmed within %s and has been dropped", userID, userID, d.Spec.VMName, confirmTimeout)
+		}
+		if _, err := sendReply(ctx, messageID, reply, true); err != nil {
+			fmt.Println("Failed to send reply:", err)
+		}
+		return
+	}
+
+	job := &Job{
+		ID: messageID,
+		Run: func(context.Context) {
+			defer release()
+			progress := NewProgress(ctx, messageID, fmt.Sprintf("Deploying VM %s", d.Spec.VMName))
+			ips, err := d.apply(ctx, progress)
+			if err != nil {
+				fmt.Println("Failed to apply Terraform plan:", err)
+				progress.Finish("Failed")
+				d.discard()
+				title := fmt.Sprintf("<at user_id=\"%s\">%s</at> Failed to create VM %s", userID, userID, d.Spec.VMName)
+				if rec, err := inventory.GetByName(d.Spec.VMName); err == nil && rec.Status == VMStatusFailed {
+					title += fmt.Sprintf(", it was partially created and is kept as failed, remove it with /destroy_vm %s", d.Spec.VMName)
+				}
+				replyFailure(ctx, messageID, title, err)
+				return
+			}
+			d.release()
+			progress.Finish("Done")
+			_, err = sendReply(ctx, messageID, fmt.Sprintf("<at user_id=\"%s\">%s</at> VM successfully created with IP addresses:\n%s", userID, userID, strings.Join(ips, "\n")), true)
+			if err != nil {
+				fmt.Println("Failed to send success message:", err)
+			}
+		},
+	}
+	if pos := scheduler.Submit(ctx, job); pos > 0 {
+		_, err := sendReply(ctx, messageID, fmt.Sprintf("Confirmed, all deployment slots are busy, the apply is queued at position %d", pos), true)
+		if err != nil {
+			fmt.Println("Failed to send reply:", err)
 		}
 	}
+}
 
-	return
+// handlePlanDecision handles /confirm and /cancel in the thread of a plan
+func handlePlanDecision(ctx context.Context, cmd Command, confirm bool) {
+	messageID := cmd.Event.Message.MessageID
+	userID := cmd.Event.Sender.UserID
+	d, ok := deployments.Get(cmd.Event.Message.ThreadID)
+	if cmd.Event.Message.ThreadID == "" || !ok {
+		sendReply(ctx, messageID, "This thread has no plan waiting for confirmation", false)
+		return
+	}
+	if !d.CanOperate(userID) {
+		sendReply(ctx, messageID, fmt.Sprintf("<at user_id=\"%s\">%s</at> This plan belongs to <at user_id=\"%s\">%s</at>, only the requester, a co-owner or an admin can confirm or cancel it", userID, userID, d.Owner, d.Owner), false)
+		return
+	}
+	if !deployments.Take(d) {
+		sendReply(ctx, messageID, "The plan has already been confirmed, cancelled or dropped", false)
+		return
+	}
+	d.Decide(confirm)
 }
 
 // Listen for replies within a specific topic
 func handleReply(ctx context.Context, cmd Command) error {
-	event := cmd.Event
-	// Ensure we are processing replies within an active topic
-	_, exists := activeTopics.Load(event.Message.ThreadID)
-	if !exists {
-		return nil // Message is not part of an active `/create_vm` topic
+	message := cmd.Event.Message
+	if message.ThreadID == "" || !message.ContainesBotMention() {
+		return nil
 	}
 
-	message := event.Message
-	if !message.ContainesBotMention() {
-		return nil
+	session, ok := sessions.Get(message.ThreadID)
+	if !ok {
+		_, err := sendReply(ctx, message.MessageID, "This thread has no pending /create_vm session, please start a new one with /create_vm", false)
+		return err
 	}
 
-	// Apply Terraform Configuration
-	config := parseConfig(message.Content.Text)
-	// Send the configuration to the handleCreateVM function
-	configChan <- config
+	if !session.CanOperate(cmd.Event.Sender.UserID) {
+		return replyNotSessionOwner(ctx, cmd.Event, session)
+	}
+
+	// Validate the configuration before anything runs, the requester can fix it and reply again
+	spec, err := ParseVMSpec(session.ProfileID, parseConfig(message.Content.Text))
+	if err == nil {
+		err = checkDeployable(session.UserID, spec)
+	}
+	if err != nil {
+		_, err := sendReply(ctx, message.MessageID, "Invalid configuration, please fix the following and reply again:\n"+err.Error(), false)
+		return err
+	}
+
+	// Hand the spec to the handleCreateVM goroutine of this thread
+	if !session.Deliver(spec) {
+		_, err := sendReply(ctx, message.MessageID, "The configuration of this session has already been submitted", false)
+		return err
+	}
 
 	return nil
 }
 
-func sendReply(ctx context.Context, messageID, content string, replyInThread bool) (*MessageResponse, error) {
-	client := lark.NewClient(AppID, AppSecret)
+// replyNotSessionOwner rejects a user acting on someone else's session
+func replyNotSessionOwner(ctx context.Context, event Event, session *Session) error {
+	_, err := sendReply(ctx, event.Message.MessageID, fmt.Sprintf("<at user_id=\"%s\">%s</at> This session belongs to <at user_id=\"%s\">%s</at>, only the requester, a co-owner or an admin can operate on it", event.Sender.UserID, event.Sender.UserID, session.UserID, session.UserID), false)
+	if err != nil {
+		fmt.Println("Failed to send reply:", err)
+	}
+	return err
+}
 
+func sendReply(ctx context.Context, messageID, content string, replyInThread bool) (*MessageResponse, error) {
 	// Properly format the content into JSON
 	contentMap := map[string]string{
 		"text": content,
@@ -172,12 +722,19 @@ func sendReply(ctx context.Context, messageID, content string, replyInThread boo
 	if err != nil {
 		return nil, err
 	}
+	return replyMessage(ctx, messageID, "text", string(contentBytes), replyInThread)
+}
+
+// replyMessage replies to a message with content of the given msg_type,
+// such as text or interactive
+func replyMessage(ctx context.Context, messageID, msgType, content string, replyInThread bool) (*MessageResponse, error) {
+	client := lark.NewClient(AppID, AppSecret)
 
 	req := larkim.NewReplyMessageReqBuilder().
 		MessageId(messageID).
 		Body(larkim.NewReplyMessageReqBodyBuilder().
-			Content(string(contentBytes)).
-			MsgType("text").
+			Content(content).
+			MsgType(msgType).
 			ReplyInThread(replyInThread).
 			Uuid(generateUUID()). // Generate a new UUID for each request
 			Build()).
@@ -196,13 +753,108 @@ func sendReply(ctx context.Context, messageID, content string, replyInThread boo
 	return msgResp, nil
 }
 
+// replyFailure explains a failed deployment in the thread. Terraform failures
+// get a diagnosis and the redacted Terraform output as a file.
+func replyFailure(ctx context.Context, messageID, title string, err error) {
+	var tfErr *TerraformError
+	if !errors.As(err, &tfErr) {
+		if _, err := sendReply(ctx, messageID, fmt.Sprintf("%s: %v", title, err), true); err != nil {
+			fmt.Println("Failed to send reply:", err)
+		}
+		return
+	}
+	if _, err := sendReply(ctx, messageID, title+"\n"+tfErr.Diagnosis(), true); err != nil {
+		fmt.Println("Failed to send reply:", err)
+	}
+	if len(tfErr.Log) == 0 {
+		return
+	}
+	name := fmt.Sprintf("terraform-%s-%s.log", tfErr.Command, time.Now().Format("20060102-150405"))
+	if err := sendFileReply(ctx, messageID, name, tfErr.Log); err != nil {
+		fmt.Println("Failed to send Terraform log:", err)
+	}
+}
+
+// sendFileReply uploads data as a file and replies with it in thread
+func sendFileReply(ctx context.Context, messageID, name string, data []byte) error {
+	client := lark.NewClient(AppID, AppSecret)
+
+	uploadReq := larkim.NewCreateFileReqBuilder().
+		Body(larkim.NewCreateFileReqBodyBuilder().
+			FileType("stream").
+			FileName(name).
+			File(bytes.NewReader(data)).
+			Build()).
+		Build()
+	uploadResp, err := client.Im.File.Create(ctx, uploadReq)
+	if err != nil {
+		return err
+	}
+	if !uploadResp.Success() {
+		return fmt.Errorf("upload file failed: %d %s", uploadResp.Code, uploadResp.Msg)
+	}
+
+	contentBytes, err := json.Marshal(map[string]string{
+		"file_key": getStringValue(uploadResp.Data.FileKey),
+	})
+	if err != nil {
+		return err
+	}
+	req := larkim.NewReplyMessageReqBuilder().
+		MessageId(messageID).
+		Body(larkim.NewReplyMessageReqBodyBuilder().
+			Content(string(contentBytes)).
+			MsgType("file").
+			ReplyInThread(true).
+			Uuid(generateUUID()).
+			Build()).
+		Build()
+	resp, err := client.Im.Message.Reply(ctx, req)
+	if err != nil {
+		return err
+	}
+	if !resp.Success() {
+		return fmt.Errorf("reply with file failed: %d %s", resp.Code, resp.Msg)
+	}
+	return nil
+}
+
+// updateMessage replaces the content of a text message sent by the bot
+func updateMessage(ctx context.Context, messageID, content string) error {
+	client := lark.NewClient(AppID, AppSecret)
+
+	contentBytes, err := json.Marshal(map[string]string{
+		"text": content,
+	})
+	if err != nil {
+		return err
+	}
+
+	req := larkim.NewUpdateMessageReqBuilder().
+		MessageId(messageID).
+		Body(larkim.NewUpdateMessageReqBodyBuilder().
+			MsgType("text").
+			Content(string(contentBytes)).
+			Build()).
+		Build()
+
+	resp, err := client.Im.Message.Update(ctx, req)
+	if err != nil {
+		return err
+	}
+	if !resp.Success() {
+		return fmt.Errorf("update message failed: %d %s", resp.Code, resp.Msg)
+	}
+	return nil
+}
+
 func parseConfig(configStr string) map[string]string {
 	config := make(map[string]string)
 	lines := strings.Split(configStr, "\n")
 	for _, line := range lines {
-		// Ignore empty lines
+		// Ignore empty lines and comments
 		line = strings.TrimSpace(line)
-		if line == "" {
+		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
 
@@ -230,84 +882,6 @@ func parseConfig(configStr string) map[string]string {
 	return config
 }
 
-func applyTerraformConfig(ctx context.Context, config map[string]string) error {
-	// fmt.Println("Applying Terraform configuration:", config)
-
-	// Retrieve the thread ID from the context and create the working directory
-	threadID, ok := ctx.Value("thread_id").(string)
-	if !ok {
-		return fmt.Errorf("thread_id not found in context")
-	}
-	dirPath := filepath.Join("generate", threadID)
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		return fmt.Errorf("failed to create directory %s: %w", dirPath, err)
-	}
-	defer clearUp(ctx)
-	fmt.Println("Running Terraform in directory:", dirPath)
-
-	// Define paths for required files and create symbolic links
-	files := map[string]string{
-		"terraform/main.tf":             "main.tf",
-		"terraform/variable.tf":         "variable.tf",
-		"terraform/.terraform":          ".terraform",
-		"terraform/.terraform.lock.hcl": ".terraform.lock.hcl",
-		"cloud-init/userdata.yaml":      "userdata.yaml",
-	}
-	for src, dest := range files {
-		absSrc, err := filepath.Abs(src)
-		if err != nil {
-			return fmt.Errorf("failed to get absolute path for %s: %w", src, err)
-		}
-		if err := createSymlink(absSrc, filepath.Join(dirPath, dest)); err != nil {
-			return err
-		}
-	}
-
-	// Write the terraform.tfvars file with configuration values
-	if err := writeTfVarsFile(filepath.Join(dirPath, "terraform.tfvars"), config); err != nil {
-		return err
-	}
-
-	// Run Terraform commands with a timeout context
-	terraformCtx, cancel := context.WithTimeout(ctx, 10*time.Minute)
-	defer cancel()
-
-	if err := runTerraformCommand(terraformCtx, dirPath, "init"); err != nil {
-		return fmt.Errorf("terraform init failed: %w", err)
-	}
-	if err := runTerraformCommand(terraformCtx, dirPath, "apply", "-auto-approve"); err != nil {
-		return fmt.Errorf("terraform apply failed: %w", err)
-	}
-
-	// Retrieve Terraform outputs
-	ips, err := getTerraformOutputIPs(terraformCtx, dirPath)
-	if err != nil {
-		return fmt.Errorf("failed to retrieve Terraform outputs: %w", err)
-	}
-	messageID, ok := ctx.Value("message_id").(string)
-	if !ok {
-		return fmt.Errorf("message_id not found in context")
-	}
-	// Send a success message with all ip addresses, use neline to separate them
-	_, err = sendReply(ctx, messageID, "VM successfully created with IP addresses:\n"+strings.Join(ips, "\n"), true)
-	if err != nil {
-		return fmt.Errorf("failed to send success message: %w", err)
-	}
-
-	return nil
-}
-
-// clearUp cleans up the working directory after Terraform deployment(wheather success or failure)
-func clearUp(ctx context.Context) error {
-	threarID, ok := ctx.Value("thread_id").(string)
-	if !ok {
-		return fmt.Errorf("thread_id not found in context")
-	}
-
-	dirPath := filepath.Join("generate", threarID)
-	return os.RemoveAll(dirPath)
-}
-
 // createSymlink safely creates a symbolic link
 func createSymlink(src, dest string) error {
 	if err := os.Symlink(src, dest); err != nil {
@@ -316,46 +890,39 @@ func createSymlink(src, dest string) error {
 	return nil
 }
 
-// writeTfVarsFile writes key-value pairs to a terraform.tfvars file
-func writeTfVarsFile(path string, config map[string]string) error {
-	file, err := os.Create(path)
+// runTerraformCommand executes a Terraform command in the specified directory,
+// env is added to the environment of the bot. Its events are logged, captured
+// and passed to handle, on failure the error is a *TerraformError holding
+// the diagnostics and the redacted output.
+func runTerraformCommand(ctx context.Context, dirPath string, env []string, handle func(tfrunner.Event), command string, args ...string) error {
+	runner := &tfrunner.Runner{Binary: TerraformBinary, Dir: dirPath, Env: env}
+	capture := newTerraformCapture(env)
+	err := runner.Run(ctx, func(ev tfrunner.Event) {
+		if ev.Stderr {
+			fmt.Fprintln(os.Stderr, ev.Message)
+		} else {
+			fmt.Println(ev.Message)
+		}
+		capture.Handle(ev)
+		if handle != nil {
+			handle(ev)
+		}
+	}, command, args...)
 	if err != nil {
-		return fmt.Errorf("failed to create terraform.tfvars: %w", err)
-	}
-	defer file.Close()
-
-	writer := bufio.NewWriter(file)
-	for key, value := range config {
-		if _, err := writer.WriteString(fmt.Sprintf("%s = \"%s\"\n", key, value)); err != nil {
-			return fmt.Errorf("failed to write to terraform.tfvars: %w", err)
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%w (%v)", err, ctx.Err())
 		}
+		return capture.Error(command, err)
 	}
-	return writer.Flush()
-}
-
-// runTerraformCommand executes a Terraform command in the specified directory
-func runTerraformCommand(ctx context.Context, dirPath, command string, args ...string) error {
-	cmd := exec.CommandContext(ctx, "terraform", append([]string{command}, args...)...)
-	cmd.Dir = dirPath
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return nil
 }
 
 // getTerraformOutputIPs retrieves the 'ip' output from Terraform
 func getTerraformOutputIPs(ctx context.Context, dirPath string) ([]string, error) {
-	cmd := exec.CommandContext(ctx, "terraform", "output", "-json")
-	cmd.Dir = dirPath
-	output, err := cmd.Output()
+	runner := &tfrunner.Runner{Binary: TerraformBinary, Dir: dirPath}
+	outputs, err := runner.Outputs(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute terraform output: %w", err)
-	}
-
-	var outputs map[string]struct {
-		Value interface{} `json:"value"`
-	}
-	if err := json.Unmarshal(output, &outputs); err != nil {
-		return nil, fmt.Errorf("failed to parse terraform output JSON: %w", err)
+		return nil, err
 	}
 
 	ipOutput, exists := outputs["ip"]
@@ -364,18 +931,9 @@ func getTerraformOutputIPs(ctx context.Context, dirPath string) ([]string, error
 	}
 
 	// Assuming 'ip' is a list of strings
-	ipList, ok := ipOutput.Value.([]interface{})
-	if !ok {
-		return nil, fmt.Errorf("unexpected type for 'ip' output")
-	}
-
 	var ips []string
-	for _, ip := range ipList {
-		ipStr, ok := ip.(string)
-		if !ok {
-			return nil, fmt.Errorf("invalid type for IP address: %v", ip)
-		}
-		ips = append(ips, ipStr)
+	if err := json.Unmarshal(ipOutput.Value, &ips); err != nil {
+		return nil, fmt.Errorf("unexpected type for 'ip' output: %w", err)
 	}
 
 	return ips, nil
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Host is an ESXi host VMs can be placed on
+type Host struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	SSHPort int    `json:"ssh_port"`
+	SSLPort int    `json:"ssl_port"`
+	// Credentials is the reference of the host's credentials in the SecretsProvider
+	Credentials string `json:"credentials"`
+	// Datastore and Network receive the disks and the NIC of the host's VMs
+	Datastore string `json:"datastore"`
+	Network   string `json:"network"`
+	Capacity  Usage  `json:"capacity"`
+}
+
+// Usage counts VMs and their resources. As a capacity, zero means unlimited.
+type Usage struct {
+	VMs    int `json:"vms"`
+	VCPUs  int `json:"vcpus"`
+	Memory int `json:"memory"` // MB
+	Disk   int `json:"disk"`   // GB
+}
+
+func (u Usage) add(o Usage) Usage {
+	return Usage{VMs: u.VMs + o.VMs, VCPUs: u.VCPUs + o.VCPUs, Memory: u.Memory + o.Memory, Disk: u.Disk + o.Disk}
+}
+
+func (u Usage) sub(o Usage) Usage {
+	return Usage{VMs: u.VMs - o.VMs, VCPUs: u.VCPUs - o.VCPUs, Memory: u.Memory - o.Memory, Disk: u.Disk - o.Disk}
+}
+
+// specUsage returns the resources a VM of the spec takes
+func specUsage(spec *VMSpec) Usage {
+	return Usage{VMs: 1, VCPUs: spec.NumVCPUs, Memory: spec.Memory, Disk: spec.DiskSize}
+}
+
+// Settings returns the operator-owned Terraform variables targeting the host
+func (h *Host) Settings() *OperatorSettings {
+	return &OperatorSettings{
+		ESXiHostname: h.Address,
+		ESXiHostport: h.SSHPort,
+		ESXiHostssl:  h.SSLPort,
+		Datastore:    h.Datastore,
+		NetworkName:  h.Network,
+	}
+}
+
+// fits reports whether used plus the requested usage stays within the capacity
+func (h *Host) fits(used, req Usage) bool {
+	total := used.add(req)
+	c := h.Capacity
+	return (c.VMs == 0 || total.VMs <= c.VMs) &&
+		(c.VCPUs == 0 || total.VCPUs <= c.VCPUs) &&
+		(c.Memory == 0 || total.Memory <= c.Memory) &&
+		(c.Disk == 0 || total.Disk <= c.Disk)
+}
+
+// load is the highest used fraction among the limited resources of the host
+func (h *Host) load(used Usage) float64 {
+	load := 0.0
+	for _, d := range [][2]int{{used.VMs, h.Capacity.VMs}, {used.VCPUs, h.Capacity.VCPUs}, {used.Memory, h.Capacity.Memory}, {used.Disk, h.Capacity.Disk}} {
+		if d[1] > 0 {
+			load = max(load, float64(d[0])/float64(d[1]))
+		}
+	}
+	return load
+}
+
+// Placement policies
+const (
+	PlacementLeastLoaded = "least-loaded"
+	PlacementRoundRobin  = "round-robin"
+)
+
+// HostRegistry holds the ESXi hosts and places new VMs on them
+type HostRegistry struct {
+	hosts  []*Host
+	policy string
+	// next is the round-robin cursor
+	next int
+	// reserved is the usage of deployments that are running but not yet in the inventory
+	reserved map[string]Usage
+	lock     sync.Mutex
+}
+
+// Global host registry, initialized in main
+var Hosts *HostRegistry
+
+// LoadHostRegistry reads the hosts from a JSON file. Without the file the
+// registry holds a single host built from the fallback operator settings.
+func LoadHostRegistry(path string, fallback *OperatorSettings, policy string) (*HostRegistry, error) {
+	if policy == "" {
+		policy = PlacementLeastLoaded
+	}
+	if policy != PlacementLeastLoaded && policy != PlacementRoundRobin {
+		return nil, fmt.Errorf("unknown placement policy %q", policy)
+	}
+	r := &HostRegistry{policy: policy, reserved: make(map[string]Usage)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		r.hosts = []*Host{{
+			Name:      "default",
+			Address:   fallback.ESXiHostname,
+			SSHPort:   fallback.ESXiHostport,
+			SSLPort:   fallback.ESXiHostssl,
+			Datastore: fallback.Datastore,
+			Network:   fallback.NetworkName,
+		}}
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hosts file %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &r.hosts); err != nil {
+		return nil, fmt.Errorf("failed to parse hosts file %s: %w", path, err)
+	}
+
+	if len(r.hosts) == 0 {
+		return nil, fmt.Errorf("hosts file %s defines no hosts", path)
+	}
+	seen := make(map[string]bool)
+	for _, h := range r.hosts {
+		if h.Name == "" || h.Address == "" {
+			return nil, fmt.Errorf("hosts file %s: every host needs a name and an address", path)
+		}
+		if seen[h.Name] {
+			return nil, fmt.Errorf("hosts file %s: duplicate host %q", path, h.Name)
+		}
+		seen[h.Name] = true
+		if h.Datastore == "" || h.Network == "" {
+			return nil, fmt.Errorf("host %q needs a datastore and a network", h.Name)
+		}
+		if h.SSHPort == 0 {
+			h.SSHPort = 22
+		}
+		if h.SSLPort == 0 {
+			h.SSLPort = 443
+		}
+	}
+	return r, nil
+}
+
+// Get returns the host with the given name, the empty name is the first host
+func (r *HostRegistry) Get(name string) (*Host, bool) {
+	if name == "" {
+		return r.hosts[0], true
+	}
+	for _, h := range r.hosts {
+		if h.Name == name {
+			return h, true
+		}
+	}
+	return nil, false
+}
+
+// Names returns the names of all hosts
+func (r *HostRegistry) Names() []string {
+	names := make([]string, len(r.hosts))
+	for i, h := range r.hosts {
+		names[i] = h.Name
+	}
+	return names
+}
+
+// Place picks a host for the spec, the one pinned by spec.Host or else one
+// chosen by the placement policy, and reserves its resources. The returned
+// release func must be called once the VM is in the inventory or has failed.
+func (r *HostRegistry) Place(spec *VMSpec) (*Host, func(), error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	used, err := r.usage()
+	if err != nil {
+		return nil, nil, err
+	}
+	req := specUsage(spec)
+
+	var host *Host
+	if spec.Host != "" {
+		h, ok := r.Get(spec.Host)
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown host %q", spec.Host)
+		}
+		if !h.fits(used[h.Name], req) {
+			return nil, nil, fmt.Errorf("host %s does not have enough capacity left", h.Name)
+		}
+		host = h
+	} else {
+		host = r.pick(used, req)
+		if host == nil {
+			return nil, nil, fmt.Errorf("no host has enough capacity left")
+		}
+	}
+
+	r.reserved[host.Name] = r.reserved[host.Name].add(req)
+	release := func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.reserved[host.Name] = r.reserved[host.Name].sub(req)
+	}
+	return host, release, nil
+}
+
+// pick chooses a host with room for req according to the policy. Caller must hold the lock.
+func (r *HostRegistry) pick(used map[string]Usage, req Usage) *Host {
+	switch r.policy {
+	case PlacementRoundRobin:
+		for i := range r.hosts {
+			h := r.hosts[(r.next+i)%len(r.hosts)]
+			if h.fits(used[h.Name], req) {
+				r.next = (r.next + i + 1) % len(r.hosts)
+				return h
+			}
+		}
+		return nil
+	default:
+		var candidates []*Host
+		for _, h := range r.hosts {
+			if h.fits(used[h.Name], req) {
+				candidates = append(candidates, h)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+		// Least loaded first, hosts without limits are compared by VM count
+		sort.SliceStable(candidates, func(i, j int) bool {
+			li, lj := candidates[i].load(used[candidates[i].Name]), candidates[j].load(used[candidates[j].Name])
+			if li != lj {
+				return li < lj
+			}
+			return used[candidates[i].Name].VMs < used[candidates[j].Name].VMs
+		})
+		return candidates[0]
+	}
+}
+
+// usage sums the inventory and reservations per host. Caller must hold the lock.
+func (r *HostRegistry) usage() (map[string]Usage, error) {
+	records, err := inventory.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VMs: %w", err)
+	}
+	used := make(map[string]Usage)
+	for _, rec := range records {
+		// VMs recorded before hosts were tracked live on the first host
+		name := rec.Host
+		if name == "" {
+			name = r.hosts[0].Name
+		}
+		used[name] = used[name].add(Usage{VMs: 1, VCPUs: rec.NumVCPUs, Memory: rec.Memory, Disk: rec.DiskSize})
+	}
+	for name, res := range r.reserved {
+		used[name] = used[name].add(res)
+	}
+	return used, nil
+}
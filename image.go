@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Image is an OS image VMs can be deployed from
+type Image struct {
+	Name      string `json:"name"`
+	OVFSource string `json:"ovf_source"`
+	OSFamily  string `json:"os_family"`
+	// DefaultUser is the ssh_username used when the spec does not set one
+	DefaultUser string `json:"default_user"`
+	// Checksum is the "sha256:<hex>" digest of a local OVF/OVA file, optional
+	Checksum string `json:"checksum"`
+}
+
+// ImageCatalog is the operator-maintained list of images, the first one is the default
+type ImageCatalog struct {
+	images []*Image
+	// verified caches the checksum results of local files by path, size and modification time
+	verified sync.Map
+}
+
+// Global image catalog, initialized in main
+var Images *ImageCatalog
+
+// LoadImageCatalog reads the image catalog. Without the file the catalog
+// holds the default ovf_source of terraform/variable.tf.
+func LoadImageCatalog(path string) (*ImageCatalog, error) {
+	c := &ImageCatalog{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		c.images = []*Image{{Name: "ubuntu-22.04", OVFSource: "jammy-server-cloudimg-amd64.ova", OSFamily: "ubuntu", DefaultUser: "ubuntu"}}
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image catalog %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &c.images); err != nil {
+		return nil, fmt.Errorf("failed to parse image catalog %s: %w", path, err)
+	}
+	if len(c.images) == 0 {
+		return nil, fmt.Errorf("image catalog %s defines no images", path)
+	}
+	seen := make(map[string]bool)
+	for _, img := range c.images {
+		if img.Name == "" || img.OVFSource == "" {
+			return nil, fmt.Errorf("image catalog %s: every image needs a name and an ovf_source", path)
+		}
+		if seen[img.Name] {
+			return nil, fmt.Errorf("image catalog %s: duplicate image %q", path, img.Name)
+		}
+		seen[img.Name] = true
+		if img.Checksum != "" && !strings.HasPrefix(img.Checksum, "sha256:") {
+			return nil, fmt.Errorf("image %q: checksum must look like sha256:<hex>", img.Name)
+		}
+	}
+	return c, nil
+}
+
+// Get returns the image with the given name, the empty name is the default image
+func (c *ImageCatalog) Get(name string) (*Image, bool) {
+	if name == "" {
+		return c.images[0], true
+	}
+	for _, img := range c.images {
+		if img.Name == name {
+			return img, true
+		}
+	}
+	return nil, false
+}
+
+// Names returns the names of all images
+func (c *ImageCatalog) Names() []string {
+	names := make([]string, len(c.images))
+	for i, img := range c.images {
+		names[i] = img.Name
+	}
+	return names
+}
+
+// Format lists the images, one per line, the default first
+func (c *ImageCatalog) Format() string {
+	var b strings.Builder
+	for i, img := range c.images {
+		fmt.Fprintf(&b, "%s: %s, default user %s", img.Name, img.OSFamily, img.DefaultUser)
+		if i == 0 {
+			b.WriteString(" (default)")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Verify checks the checksum of an image stored as a local file. Images
+// without a checksum or downloaded from a URL are not checked here.
+func (c *ImageCatalog) Verify(img *Image) error {
+	if img.Checksum == "" || strings.Contains(img.OVFSource, "://") {
+		return nil
+	}
+	info, err := os.Stat(img.OVFSource)
+	if err != nil {
+		return fmt.Errorf("image %s: %w", img.Name, err)
+	}
+	cacheKey := fmt.Sprintf("%s|%d|%d", img.OVFSource, info.Size(), info.ModTime().UnixNano())
+	if sum, ok := c.verified.Load(cacheKey); ok && sum == img.Checksum {
+		return nil
+	}
+
+	f, err := os.Open(img.OVFSource)
+	if err != nil {
+		return fmt.Errorf("image %s: %w", img.Name, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("image %s: failed to read: %w", img.Name, err)
+	}
+	sum := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(sum, img.Checksum) {
+		return fmt.Errorf("image %s: checksum mismatch, expected %s, got %s", img.Name, img.Checksum, sum)
+	}
+	c.verified.Store(cacheKey, img.Checksum)
+	return nil
+}
@@ -119,6 +119,8 @@ type Message struct {
 	ThreadID  string   `json:"thread_id"`
 	Content   Content  `json:"content"`
 	Mentions  []string `json:"mentions"`
+	// MentionUserIDs are the user ids of the mentioned users, bots have none
+	MentionUserIDs []string `json:"-"`
 	// etc.
 }
 
@@ -132,6 +134,9 @@ func (m *Message) UnmarshalJSON(data []byte) error {
 		Mentions  []struct {
 			Key  string `json:"key"`
 			Name string `json:"name"`
+			ID   struct {
+				UserID string `json:"user_id"`
+			} `json:"id"`
 		} `json:"mentions"`
 	}
 
@@ -155,6 +160,9 @@ func (m *Message) UnmarshalJSON(data []byte) error {
 		for _, mention := range a.Mentions {
 			mentionKeys = append(mentionKeys, mention.Key)
 			m.Mentions = append(m.Mentions, mention.Name)
+			if mention.ID.UserID != "" {
+				m.MentionUserIDs = append(m.MentionUserIDs, mention.ID.UserID)
+			}
 		}
 		// Remove mention keys from the content text
 		cleanedText := removeMentions(m.Content.Text, mentionKeys)
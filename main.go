@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"path/filepath"
 	"strings"
+	"syscall"
 
 	larkcore "github.com/larksuite/oapi-sdk-go/v3/core"
 	larkevent "github.com/larksuite/oapi-sdk-go/v3/event"
@@ -14,9 +16,67 @@ import (
 
 var commandQueue = &CommandQueue{}
 
+// Runs Terraform deployments, limited to MaxParallelJobs at once
+var scheduler *Scheduler
+
 func main() {
+	// Terraform writes plans and state with the credentials in them, keep
+	// every file the bot and its Terraform runs create private
+	syscall.Umask(0077)
+
+	if err := readConfig(); err != nil {
+		panic(err)
+	}
+	var err error
+	inventory, err = NewFileStore(filepath.Join(DataDir, "vms.json"))
+	if err != nil {
+		panic(err)
+	}
+	if err := cleanupWorkspaces(); err != nil {
+		panic(err)
+	}
+	Secrets, err = NewSecretsProvider()
+	if err != nil {
+		panic(err)
+	}
+	Hosts, err = LoadHostRegistry(HostsFile, Operator, PlacementPolicy)
+	if err != nil {
+		panic(err)
+	}
+	Quotas, err = LoadQuotas(QuotaFile)
+	if err != nil {
+		panic(err)
+	}
+	Flavors, err = LoadFlavors(FlavorsFile)
+	if err != nil {
+		panic(err)
+	}
+	profiles, err = NewProfileFileStore(filepath.Join(DataDir, "profiles.json"))
+	if err != nil {
+		panic(err)
+	}
+	templates, err = NewTemplateFileStore(filepath.Join(DataDir, "templates.json"))
+	if err != nil {
+		panic(err)
+	}
+	TeamSSHKeys, err = loadTeamSSHKeys(TeamSSHKeysFile)
+	if err != nil {
+		panic(err)
+	}
+	CloudInit, err = LoadCloudInitConfig(CloudInitFile)
+	if err != nil {
+		panic(err)
+	}
+	Images, err = LoadImageCatalog(ImagesFile)
+	if err != nil {
+		panic(err)
+	}
+	ExampleConfig = DefaultVMSpec().ExampleConfig()
+	scheduler = NewScheduler(MaxParallelJobs)
+
 	eventHandler := dispatcher.NewEventDispatcher("", "").
-		OnCustomizedEvent("im.message.receive_v1", HandleMessage)
+		OnCustomizedEvent("im.message.receive_v1", HandleMessage).
+		OnP2CardActionTrigger(handleCardAction)
 	cli := larkws.NewClient(AppID, AppSecret,
 		larkws.WithEventHandler(eventHandler),
 		larkws.WithLogLevel(larkcore.LogLevelInfo),
@@ -26,7 +86,7 @@ func main() {
 
 	go processCommands(ctx, commandQueue)
 
-	err := cli.Start(ctx)
+	err = cli.Start(ctx)
 	if err != nil {
 		panic(err)
 	}
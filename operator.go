@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// OperatorSettings are the Terraform variables owned by the operator: where
+// VMs are created. They are loaded on the server and never shown to or
+// accepted from users. Credentials come from the SecretsProvider instead.
+type OperatorSettings struct {
+	ESXiHostname string `tfvar:"esxi_hostname"`
+	ESXiHostport int    `tfvar:"esxi_hostport"`
+	ESXiHostssl  int    `tfvar:"esxi_hostssl"`
+	Datastore    string `tfvar:"datastore"`
+	NetworkName  string `tfvar:"network_name"`
+}
+
+// Global operator settings, loaded in init
+var Operator *OperatorSettings
+
+// DefaultOperatorSettings returns the defaults of terraform/variable.tf
+func DefaultOperatorSettings() *OperatorSettings {
+	return &OperatorSettings{
+		ESXiHostname: "192.168.114.99",
+		ESXiHostport: 22,
+		ESXiHostssl:  443,
+		Datastore:    "99-datastore0",
+		NetworkName:  "VM Network",
+	}
+}
+
+// loadOperatorSettings reads the operator settings from a tfvars file on the
+// server. Keys that are not operator-owned are ignored, so are credentials.
+func loadOperatorSettings(path string) (*OperatorSettings, error) {
+	settings := DefaultOperatorSettings()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return settings, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	v := reflect.ValueOf(settings).Elem()
+	fields := tfvarFields(v.Type())
+	for key, value := range parseConfig(string(data)) {
+		if isCredentialVar(key) {
+			fmt.Printf("Ignoring %s in %s, credentials are read from the secrets provider\n", key, path)
+			continue
+		}
+		i, ok := fields[key]
+		if !ok {
+			continue
+		}
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s is not a whole number", key, value)
+			}
+			field.SetInt(int64(n))
+		}
+	}
+	return settings, nil
+}
+
+// Validate checks that the settings are complete
+func (o *OperatorSettings) Validate() error {
+	if o.ESXiHostname == "" {
+		return fmt.Errorf("esxi_hostname is required")
+	}
+	if o.ESXiHostport < 1 || o.ESXiHostport > 65535 {
+		return fmt.Errorf("esxi_hostport: %d is not a valid port", o.ESXiHostport)
+	}
+	if o.ESXiHostssl < 1 || o.ESXiHostssl > 65535 {
+		return fmt.Errorf("esxi_hostssl: %d is not a valid port", o.ESXiHostssl)
+	}
+	return nil
+}
+
+// isOperatorVar reports whether a Terraform variable is owned by the operator
+func isOperatorVar(key string) bool {
+	_, ok := tfvarFields(reflect.TypeOf(OperatorSettings{}))[key]
+	return ok || isCredentialVar(key) || key == "team_ssh_keys" || key == "cloud_config"
+}
+
+// TeamSSHKeys are authorized on every VM, loaded in main
+var TeamSSHKeys []string
+
+// loadTeamSSHKeys reads public keys in authorized_keys format, one per line.
+// Without the file there are no team keys.
+func loadTeamSSHKeys(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read team SSH keys %s: %w", path, err)
+	}
+	var keys []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := validateSSHPublicKey(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		keys = append(keys, line)
+	}
+	return keys, nil
+}
+
+// isCredentialVar reports whether a Terraform variable holds credentials
+func isCredentialVar(key string) bool {
+	for _, name := range credentialVars {
+		if name == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Vars returns the settings as Terraform variable values keyed by variable name
+func (o *OperatorSettings) Vars() map[string]interface{} {
+	return tfvarValues(o)
+}
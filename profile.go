@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SSHKey is a public key stored in a user's profile
+type SSHKey struct {
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"`
+	AddedAt     time.Time `json:"added_at"`
+}
+
+// Profile holds per-user settings
+type Profile struct {
+	UserID  string   `json:"user_id"`
+	SSHKeys []SSHKey `json:"ssh_keys"`
+}
+
+// AuthorizedKeys returns the stored public keys
+func (p *Profile) AuthorizedKeys() []string {
+	keys := make([]string, len(p.SSHKeys))
+	for i, k := range p.SSHKeys {
+		keys[i] = k.Key
+	}
+	return keys
+}
+
+var (
+	ErrSSHKeyExists   = errors.New("ssh key already stored")
+	ErrSSHKeyNotFound = errors.New("ssh key not found")
+)
+
+// ProfileStore persists user profiles
+type ProfileStore interface {
+	// Get returns the profile of a user, an empty one if none is stored
+	Get(userID string) (*Profile, error)
+	// AddSSHKey validates and stores a public key, it returns the stored key
+	AddSSHKey(userID, key string) (*SSHKey, error)
+	// RemoveSSHKey removes the key with the given fingerprint
+	RemoveSSHKey(userID, fingerprint string) error
+}
+
+// Global profile store, initialized in main
+var profiles ProfileStore
+
+// profileFileStore is a ProfileStore persisted as a JSON file
+type profileFileStore struct {
+	path     string
+	lock     sync.RWMutex
+	profiles map[string]*Profile
+}
+
+// NewProfileFileStore opens the JSON profile store at path, creating it if needed
+func NewProfileFileStore(path string) (ProfileStore, error) {
+	s := &profileFileStore{path: path, profiles: make(map[string]*Profile)}
+	list, err := loadJSONList[*Profile](path, "profiles")
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range list {
+		s.profiles[p.UserID] = p
+	}
+	return s, nil
+}
+
+func (s *profileFileStore) Get(userID string) (*Profile, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	p, ok := s.profiles[userID]
+	if !ok {
+		return &Profile{UserID: userID}, nil
+	}
+	// Return a copy so callers never race with updates
+	cp := *p
+	cp.SSHKeys = append([]SSHKey(nil), p.SSHKeys...)
+	return &cp, nil
+}
+
+func (s *profileFileStore) AddSSHKey(userID, key string) (*SSHKey, error) {
+	key = strings.TrimSpace(key)
+	if err := validateSSHPublicKey(key); err != nil {
+		return nil, err
+	}
+	fingerprint, err := sshKeyFingerprint(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p, ok := s.profiles[userID]
+	if !ok {
+		p = &Profile{UserID: userID}
+		s.profiles[userID] = p
+	}
+	for _, k := range p.SSHKeys {
+		if k.Fingerprint == fingerprint {
+			return nil, ErrSSHKeyExists
+		}
+	}
+	stored := SSHKey{Key: key, Fingerprint: fingerprint, AddedAt: time.Now()}
+	p.SSHKeys = append(p.SSHKeys, stored)
+	return &stored, s.save()
+}
+
+func (s *profileFileStore) RemoveSSHKey(userID, fingerprint string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p, ok := s.profiles[userID]
+	if !ok {
+		return ErrSSHKeyNotFound
+	}
+	for i, k := range p.SSHKeys {
+		if k.Fingerprint == fingerprint {
+			p.SSHKeys = append(p.SSHKeys[:i], p.SSHKeys[i+1:]...)
+			return s.save()
+		}
+	}
+	return ErrSSHKeyNotFound
+}
+
+// save writes the profiles ordered by user. Caller must hold the lock.
+func (s *profileFileStore) save() error {
+	list := make([]*Profile, 0, len(s.profiles))
+	for _, id := range sortedKeys(s.profiles) {
+		list = append(list, s.profiles[id])
+	}
+	return saveJSONList(s.path, "profiles", list)
+}
+
+// profileID returns the key of a sender's profile, the user id or, when the
+// app has no permission to read user ids, the open id
+func profileID(sender Sender) string {
+	if sender.UserID != "" {
+		return sender.UserID
+	}
+	return sender.OpenID
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Xunop/SAST-VMCreator/tfrunner"
+)
+
+const (
+	// progressInterval is the minimum time between two edits of a status message
+	progressInterval = 5 * time.Second
+	// progressMaxEdits keeps below Lark's limit on edits of one message, the
+	// status continues in a new message once it is reached
+	progressMaxEdits = 18
+)
+
+// Lines of Terraform's human-readable output that start a new phase
+var (
+	initPattern     = regexp.MustCompile(`^Initializing (the backend|provider plugins)`)
+	planPattern     = regexp.MustCompile(`^Plan: (\d+) to add, (\d+) to change, (\d+) to destroy`)
+	resourcePattern = regexp.MustCompile(`^([\w.\[\]"-]+): (Creating|Destroying|Modifying|Still creating|Still destroying|Still modifying)\.\.\.(?: \[(?:id=[^,\]]*, )?([\dhms]+) elapsed\])?`)
+	completePattern = regexp.MustCompile(`^([\w.\[\]"-]+): (Creation|Destruction|Modifications) complete`)
+	applyPattern    = regexp.MustCompile(`^(Apply|Destroy) complete!`)
+	ansiPattern     = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+)
+
+// Progress reports the phase of a Terraform run by editing a status message
+// in the thread. Edits are throttled and only made when the phase changes,
+// the final status is always sent.
+type Progress struct {
+	ctx       context.Context
+	replyTo   string
+	messageID string
+	title     string
+	started   time.Time
+
+	lock  sync.Mutex
+	phase string
+	// elapsed is the time Terraform reports for the current phase, it is
+	// shown but does not count as a change
+	elapsed   string
+	done      []string
+	sentPhase string
+	sentDone  int
+	lastEdit  time.Time
+	edits     int
+}
+
+// NewProgress replies to messageID in thread with a status message headed by
+// title. It returns nil if the message cannot be sent, a nil Progress reports
+// nothing.
+func NewProgress(ctx context.Context, messageID, title string) *Progress {
+	p := &Progress{ctx: ctx, replyTo: messageID, title: title, started: time.Now(), phase: "Starting"}
+	resp, err := sendReply(ctx, messageID, p.render(), true)
+	if err != nil {
+		fmt.Println("Failed to send status message:", err)
+		return nil
+	}
+	p.messageID = resp.MessageID
+	p.sentPhase = p.phase
+	p.lastEdit = time.Now()
+	return p
+}
+
+// SetPhase moves the status to a new phase
+func (p *Progress) SetPhase(phase string) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.moveTo(phase, "")
+	p.flush(false)
+}
+
+// Finish replaces the phase with the final status
+func (p *Progress) Finish(status string) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.moveTo(fmt.Sprintf("%s (%s)", status, time.Since(p.started).Round(time.Second)), "")
+	p.flush(true)
+}
+
+// Handle follows the phases of a Terraform run from its events
+func (p *Progress) Handle(ev tfrunner.Event) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if ev.Type == tfrunner.EventText {
+		p.parseLine(strings.TrimSpace(ansiPattern.ReplaceAllString(ev.Message, "")))
+	} else {
+		p.parseMessage(ev)
+	}
+	p.flush(false)
+}
+
+// parseLine updates the phase from a line of Terraform's human-readable
+// output, such as the output of init. Caller must hold the lock.
+func (p *Progress) parseLine(line string) {
+	switch {
+	case initPattern.MatchString(line):
+		p.moveTo("Initializing Terraform", "")
+	case planPattern.MatchString(line):
+		m := planPattern.FindStringSubmatch(line)
+		p.moveTo(fmt.Sprintf("Planned: %s to add, %s to change, %s to destroy", m[1], m[2], m[3]), "")
+	case resourcePattern.MatchString(line):
+		m := resourcePattern.FindStringSubmatch(line)
+		p.moveTo(resourcePhase(m[1], m[2]), m[3])
+	case completePattern.MatchString(line):
+		m := completePattern.FindStringSubmatch(line)
+		p.done = append(p.done, fmt.Sprintf("%s: %s complete", m[1], strings.ToLower(m[2])))
+		p.moveTo("Applying", "")
+	case applyPattern.MatchString(line):
+		p.moveTo(applyPattern.FindStringSubmatch(line)[1]+" complete", "")
+	}
+}
+
+// parseMessage updates the phase from a -json message. Caller must hold the lock.
+func (p *Progress) parseMessage(msg tfrunner.Event) {
+	if msg.Hook == nil && strings.HasPrefix(string(msg.Type), "apply_") {
+		return
+	}
+	switch msg.Type {
+	case tfrunner.EventChangeSummary:
+		c := msg.Changes
+		if c == nil {
+			return
+		}
+		if c.Operation == "plan" || c.Operation == "" {
+			p.moveTo(fmt.Sprintf("Planned: %d to add, %d to change, %d to destroy", c.Add, c.Change, c.Remove), "")
+		} else {
+			p.moveTo(strings.ToUpper(c.Operation[:1])+c.Operation[1:]+" complete", "")
+		}
+	case tfrunner.EventApplyStart, tfrunner.EventApplyProgress:
+		action := map[string]string{"create": "Creating", "delete": "Destroying", "update": "Modifying"}[msg.Hook.Action]
+		if action == "" {
+			action = "Applying"
+		}
+		var elapsed string
+		if msg.Hook.ElapsedSeconds > 0 {
+			elapsed = msg.Hook.Elapsed().String()
+		}
+		p.moveTo(resourcePhase(msg.Hook.Resource.Addr, action), elapsed)
+	case tfrunner.EventApplyComplete:
+		p.done = append(p.done, fmt.Sprintf("%s: %s complete", msg.Hook.Resource.Addr, msg.Hook.Action))
+		p.moveTo("Applying", "")
+	case tfrunner.EventApplyErrored:
+		p.moveTo(fmt.Sprintf("%s failed", msg.Hook.Resource.Addr), "")
+	}
+}
+
+// moveTo sets the phase and the time Terraform reports for it. Caller must hold the lock.
+func (p *Progress) moveTo(phase, elapsed string) {
+	p.phase = phase
+	p.elapsed = elapsed
+}
+
+// resourcePhase describes what Terraform is doing to a resource. The esxi
+// provider creates the guest by importing the image, powering it on and
+// waiting until VMware Tools reports an IP, all within "Creating".
+func resourcePhase(resource, action string) string {
+	action = strings.TrimPrefix(action, "Still ")
+	action = strings.ToUpper(action[:1]) + action[1:]
+	if strings.HasPrefix(resource, "esxi_guest.") && action == "Creating" {
+		return fmt.Sprintf("Creating %s, importing the image, booting and waiting for an IP", resource)
+	}
+	return fmt.Sprintf("%s %s", action, resource)
+}
+
+func (p *Progress) render() string {
+	var b strings.Builder
+	b.WriteString(p.title)
+	for _, line := range p.done {
+		b.WriteString("\n✓ " + line)
+	}
+	fmt.Fprintf(&b, "\n[%s] %s", time.Since(p.started).Round(time.Second), p.phase)
+	if p.elapsed != "" {
+		fmt.Fprintf(&b, " (%s elapsed)", p.elapsed)
+	}
+	return b.String()
+}
+
+// flush edits the status message if the phase changed and the throttle
+// allows it. The elapsed times in the text always differ, so they are not
+// compared. Once a message has used up its edits the status continues in a
+// new message. Caller must hold the lock.
+func (p *Progress) flush(final bool) {
+	if p.phase == p.sentPhase && len(p.done) == p.sentDone {
+		return
+	}
+	if !final && time.Since(p.lastEdit) < progressInterval {
+		return
+	}
+	text := p.render()
+	if p.edits >= progressMaxEdits {
+		resp, err := sendReply(p.ctx, p.replyTo, text, true)
+		if err != nil {
+			fmt.Println("Failed to send status message:", err)
+			return
+		}
+		p.messageID = resp.MessageID
+		p.edits = 0
+	} else {
+		if err := updateMessage(p.ctx, p.messageID, text); err != nil {
+			fmt.Println("Failed to update status message:", err)
+			return
+		}
+		p.edits++
+	}
+	p.sentPhase = p.phase
+	p.sentDone = len(p.done)
+	p.lastEdit = time.Now()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// QuotaGroup limits the combined usage of its members
+type QuotaGroup struct {
+	Members []string `json:"members"`
+	Limits  Usage    `json:"limits"`
+}
+
+// QuotaConfig is the operator's quota file. Limits of zero are unlimited.
+type QuotaConfig struct {
+	// Default applies to every user without an entry in Users
+	Default Usage `json:"default"`
+	// Users overrides the default limits per user id
+	Users map[string]Usage `json:"users"`
+	// Groups limit the combined usage of their members
+	Groups map[string]QuotaGroup `json:"groups"`
+}
+
+// QuotaManager enforces per-user and per-group quotas against the inventory
+type QuotaManager struct {
+	config QuotaConfig
+	// reserved is the usage of deployments that are queued or running, per user
+	reserved map[string]Usage
+	lock     sync.Mutex
+}
+
+// Global quota manager, initialized in main
+var Quotas *QuotaManager
+
+// LoadQuotas reads the quota file, without it nobody is limited
+func LoadQuotas(path string) (*QuotaManager, error) {
+	m := &QuotaManager{reserved: make(map[string]Usage)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quota file %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &m.config); err != nil {
+		return nil, fmt.Errorf("failed to parse quota file %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// UserLimits returns the limits of a single user
+func (m *QuotaManager) UserLimits(userID string) Usage {
+	if limits, ok := m.config.Users[userID]; ok {
+		return limits
+	}
+	return m.config.Default
+}
+
+// groupsOf returns the names of the groups a user belongs to, in order
+func (m *QuotaManager) groupsOf(userID string) []string {
+	var groups []string
+	for _, name := range sortedKeys(m.config.Groups) {
+		for _, member := range m.config.Groups[name].Members {
+			if member == userID {
+				groups = append(groups, name)
+				break
+			}
+		}
+	}
+	return groups
+}
+
+// Reserve checks that a VM of the spec fits the quotas of the user and
+// their groups, and holds its resources until release is called, once the
+// VM is in the inventory or has failed
+func (m *QuotaManager) Reserve(userID string, spec *VMSpec) (func(), error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	req := specUsage(spec)
+	if err := m.check(userID, req); err != nil {
+		return nil, err
+	}
+	m.reserved[userID] = m.reserved[userID].add(req)
+	release := func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		m.reserved[userID] = m.reserved[userID].sub(req)
+	}
+	return release, nil
+}
+
+// Check reports whether a VM of the spec fits the quotas of the user and
+// their groups without reserving anything, Reserve checks again
+func (m *QuotaManager) Check(userID string, spec *VMSpec) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.check(userID, specUsage(spec))
+}
+
+// check returns the quotas req would exceed. Caller must hold the lock.
+func (m *QuotaManager) check(userID string, req Usage) error {
+	used, err := m.usage(userID)
+	if err != nil {
+		return err
+	}
+	var problems []string
+	if over := exceeded(used.add(req), m.UserLimits(userID)); len(over) > 0 {
+		problems = append(problems, "your quota: "+strings.Join(over, ", "))
+	}
+	for _, name := range m.groupsOf(userID) {
+		group := m.config.Groups[name]
+		used, err := m.groupUsage(group)
+		if err != nil {
+			return err
+		}
+		if over := exceeded(used.add(req), group.Limits); len(over) > 0 {
+			problems = append(problems, fmt.Sprintf("quota of group %s: %s", name, strings.Join(over, ", ")))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("quota exceeded\n%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// Report renders the usage of a user and their groups against the limits
+func (m *QuotaManager) Report(userID string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	used, err := m.usage(userID)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Quota of %s:\n%s", userID, formatQuota(used, m.UserLimits(userID)))
+	for _, name := range m.groupsOf(userID) {
+		group := m.config.Groups[name]
+		used, err := m.groupUsage(group)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "\nQuota of group %s:\n%s", name, formatQuota(used, group.Limits))
+	}
+	return b.String(), nil
+}
+
+// usage sums the inventory and reservations of a user. Caller must hold the lock.
+func (m *QuotaManager) usage(userID string) (Usage, error) {
+	records, err := inventory.ListByOwner(userID)
+	if err != nil {
+		return Usage{}, fmt.Errorf("failed to list VMs: %w", err)
+	}
+	used := m.reserved[userID]
+	for _, rec := range records {
+		used = used.add(Usage{VMs: 1, VCPUs: rec.NumVCPUs, Memory: rec.Memory, Disk: rec.DiskSize})
+	}
+	return used, nil
+}
+
+// groupUsage sums the usage of all members of a group. Caller must hold the lock.
+func (m *QuotaManager) groupUsage(group QuotaGroup) (Usage, error) {
+	var used Usage
+	for _, member := range group.Members {
+		u, err := m.usage(member)
+		if err != nil {
+			return Usage{}, err
+		}
+		used = used.add(u)
+	}
+	return used, nil
+}
+
+// exceeded lists the resources of used that are over their limit
+func exceeded(used, limits Usage) []string {
+	var over []string
+	if limits.VMs > 0 && used.VMs > limits.VMs {
+		over = append(over, fmt.Sprintf("VMs %d/%d", used.VMs, limits.VMs))
+	}
+	if limits.VCPUs > 0 && used.VCPUs > limits.VCPUs {
+		over = append(over, fmt.Sprintf("vCPUs %d/%d", used.VCPUs, limits.VCPUs))
+	}
+	if limits.Memory > 0 && used.Memory > limits.Memory {
+		over = append(over, fmt.Sprintf("memory %d/%d MB", used.Memory, limits.Memory))
+	}
+	if limits.Disk > 0 && used.Disk > limits.Disk {
+		over = append(over, fmt.Sprintf("disk %d/%d GB", used.Disk, limits.Disk))
+	}
+	return over
+}
+
+// formatQuota renders usage against limits, one resource per line
+func formatQuota(used, limits Usage) string {
+	limit := func(n int, unit string) string {
+		if n == 0 {
+			return "unlimited"
+		}
+		return fmt.Sprintf("%d%s", n, unit)
+	}
+	return fmt.Sprintf("VMs: %d / %s\nvCPUs: %d / %s\nMemory: %d MB / %s\nDisk: %d GB / %s",
+		used.VMs, limit(limits.VMs, ""),
+		used.VCPUs, limit(limits.VCPUs, ""),
+		used.Memory, limit(limits.Memory, " MB"),
+		used.Disk, limit(limits.Disk, " GB"))
+}
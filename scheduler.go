@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Job is a unit of work run by the Scheduler
+type Job struct {
+	ID  string
+	Run func(ctx context.Context)
+}
+
+// Scheduler runs up to a fixed number of jobs concurrently, queueing the rest
+// in submission order
+type Scheduler struct {
+	slots   int
+	running int
+	pending []*Job
+	lock    sync.Mutex
+}
+
+func NewScheduler(slots int) *Scheduler {
+	if slots < 1 {
+		slots = 1
+	}
+	return &Scheduler{slots: slots}
+}
+
+// Submit schedules a job and returns its position in the queue,
+// 0 if the job started right away
+func (s *Scheduler) Submit(ctx context.Context, job *Job) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.running < s.slots {
+		s.running++
+		go s.run(ctx, job)
+		return 0
+	}
+	s.pending = append(s.pending, job)
+	return len(s.pending)
+}
+
+// run executes a job, then hands its slot to the next waiting job
+func (s *Scheduler) run(ctx context.Context, job *Job) {
+	for job != nil {
+		job.Run(ctx)
+
+		s.lock.Lock()
+		if len(s.pending) == 0 {
+			s.running--
+			job = nil
+		} else {
+			job = s.pending[0]
+			s.pending = s.pending[1:]
+		}
+		s.lock.Unlock()
+	}
+}
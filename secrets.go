@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Credentials log in to an ESXi host
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// SecretsProvider looks up ESXi credentials by reference, the empty
+// reference names the default credentials
+type SecretsProvider interface {
+	Credentials(ctx context.Context, ref string) (*Credentials, error)
+}
+
+// Global secrets provider, initialized in main
+var Secrets SecretsProvider
+
+// Terraform variables holding credentials. They are passed to Terraform as
+// TF_VAR_ environment variables and never written to a workspace.
+var credentialVars = []string{"esxi_username", "esxi_password"}
+
+// Credential variables whose values are secret and redacted from logs, the
+// username is not, it is usually root and appears all over the output
+var secretVars = []string{"esxi_password"}
+
+// NewSecretsProvider builds the provider selected by SECRETS_PROVIDER:
+// env (default), file or vault
+func NewSecretsProvider() (SecretsProvider, error) {
+	switch kind := os.Getenv("SECRETS_PROVIDER"); kind {
+	case "", "env":
+		return envSecrets{}, nil
+	case "file":
+		path := os.Getenv("SECRETS_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("SECRETS_FILE is required for the file secrets provider")
+		}
+		return &fileSecrets{path: path}, nil
+	case "vault":
+		return newVaultSecrets(os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN"), os.Getenv("VAULT_KV_MOUNT"), os.Getenv("VAULT_SECRET_PATH"))
+	default:
+		return nil, fmt.Errorf("unknown secrets provider %q", kind)
+	}
+}
+
+// terraformEnv returns the TF_VAR_ environment variables carrying the
+// credentials named by ref
+func terraformEnv(ctx context.Context, ref string) ([]string, error) {
+	creds, err := Secrets.Credentials(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ESXi credentials: %w", err)
+	}
+	if creds.Password == "" {
+		return nil, fmt.Errorf("ESXi password for %q is empty", ref)
+	}
+	env := []string{"TF_VAR_esxi_password=" + creds.Password}
+	// Fall back to the default of variable.tf when no username is set
+	if creds.Username != "" {
+		env = append(env, "TF_VAR_esxi_username="+creds.Username)
+	}
+	return env, nil
+}
+
+// envSecrets reads ESXI_USERNAME and ESXI_PASSWORD, or ESXI_<REF>_USERNAME
+// and ESXI_<REF>_PASSWORD for a named reference
+type envSecrets struct{}
+
+func (envSecrets) Credentials(ctx context.Context, ref string) (*Credentials, error) {
+	prefix := "ESXI_"
+	if ref != "" {
+		prefix += envName(ref) + "_"
+	}
+	creds := &Credentials{
+		Username: os.Getenv(prefix + "USERNAME"),
+		Password: os.Getenv(prefix + "PASSWORD"),
+	}
+	if creds.Password == "" {
+		return nil, fmt.Errorf("%sPASSWORD is not set", prefix)
+	}
+	return creds, nil
+}
+
+// envName turns a reference into an environment variable name fragment
+func envName(ref string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, ref)
+}
+
+// fileSecrets reads a JSON file mapping references to credentials, the
+// default credentials are stored under "default":
+//
+//	{"default": {"username": "root", "password": "..."}}
+//
+// The file must not be accessible by group or others.
+type fileSecrets struct {
+	path string
+}
+
+func (f *fileSecrets) Credentials(ctx context.Context, ref string) (*Credentials, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat secrets file: %w", err)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return nil, fmt.Errorf("secrets file %s has permissions %04o, it must not be accessible by group or others (chmod 600)", f.path, perm)
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets file: %w", err)
+	}
+	var all map[string]*Credentials
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, fmt.Errorf("failed to parse secrets file: %w", err)
+	}
+	if ref == "" {
+		ref = "default"
+	}
+	creds, ok := all[ref]
+	if !ok || creds == nil {
+		return nil, fmt.Errorf("no credentials for %q in secrets file", ref)
+	}
+	return creds, nil
+}
+
+// vaultSecrets reads credentials from a HashiCorp Vault KV version 2 secrets
+// engine, at <mount>/data/<path>/<ref>. The secret holds username and password.
+type vaultSecrets struct {
+	addr   *url.URL
+	token  string
+	mount  string
+	path   string
+	client *http.Client
+}
+
+func newVaultSecrets(addr, token, mount, path string) (*vaultSecrets, error) {
+	if addr == "" || token == "" {
+		return nil, fmt.Errorf("VAULT_ADDR and VAULT_TOKEN are required for the vault secrets provider")
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAULT_ADDR: %w", err)
+	}
+	if mount == "" {
+		mount = "secret"
+	}
+	if path == "" {
+		path = "esxi"
+	}
+	return &vaultSecrets{
+		addr:   u,
+		token:  token,
+		mount:  strings.Trim(mount, "/"),
+		path:   strings.Trim(path, "/"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (v *vaultSecrets) Credentials(ctx context.Context, ref string) (*Credentials, error) {
+	if ref == "" {
+		ref = "default"
+	}
+	u := v.addr.JoinPath("v1", v.mount, "data", v.path, ref)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query vault: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault returned %s for %s", resp.Status, u.Path)
+	}
+
+	var body struct {
+		Data struct {
+			Data *Credentials `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to parse vault response: %w", err)
+	}
+	if body.Data.Data == nil {
+		return nil, errors.New("vault secret has no data")
+	}
+	return body.Data.Data, nil
+}
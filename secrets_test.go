@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newVaultStub serves KV version 2 secrets from paths, keyed by request
+// path, and rejects requests without the token
+func newVaultStub(t *testing.T, token string, paths map[string]string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("X-Vault-Token") != token {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		body, ok := paths[r.URL.Path]
+		if !ok {
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestVaultSecretsCredentials(t *testing.T) {
+	srv := newVaultStub(t, "s.token", map[string]string{
+		"/v1/secret/data/esxi/default": `{"data":{"data":{"username":"root","password":"hunter2"},"metadata":{"version":3}}}`,
+		"/v1/kv/data/lab/esxi/host-b":  `{"data":{"data":{"username":"admin","password":"s3cret"}}}`,
+		"/v1/secret/data/esxi/empty":   `{"data":{"metadata":{"version":1}}}`,
+		"/v1/secret/data/esxi/broken":  `{"data":`,
+	})
+
+	tests := []struct {
+		name    string
+		token   string
+		mount   string
+		path    string
+		ref     string
+		want    *Credentials
+		wantErr string
+	}{
+		{name: "default reference", token: "s.token", ref: "", want: &Credentials{Username: "root", Password: "hunter2"}},
+		{name: "mount and path", token: "s.token", mount: "/kv/", path: "lab/esxi", ref: "host-b", want: &Credentials{Username: "admin", Password: "s3cret"}},
+		{name: "missing secret", token: "s.token", ref: "host-c", wantErr: "404"},
+		{name: "wrong token", token: "s.other", ref: "", wantErr: "403"},
+		{name: "no data", token: "s.token", ref: "empty", wantErr: "no data"},
+		{name: "invalid response", token: "s.token", ref: "broken", wantErr: "failed to parse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newVaultSecrets(srv.URL, tt.token, tt.mount, tt.path)
+			if err != nil {
+				t.Fatalf("newVaultSecrets() error = %v", err)
+			}
+			got, err := v.Credentials(context.Background(), tt.ref)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Credentials() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Credentials() error = %v", err)
+			}
+			if *got != *tt.want {
+				t.Errorf("Credentials() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewVaultSecretsRequiresAddrAndToken(t *testing.T) {
+	if _, err := newVaultSecrets("", "s.token", "", ""); err == nil {
+		t.Error("newVaultSecrets() without an address succeeded")
+	}
+	if _, err := newVaultSecrets("http://127.0.0.1:8200", "", "", ""); err == nil {
+		t.Error("newVaultSecrets() without a token succeeded")
+	}
+}
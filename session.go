@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// SessionState is the stage a `/create_vm` session is in
+type SessionState int
+
+const (
+	// SessionCollecting waits for the requester to reply with a configuration
+	SessionCollecting SessionState = iota
+	// SessionDeploying has received its configuration, the deployment is queued or running
+	SessionDeploying
+	// SessionClosed was released or timed out before receiving a configuration
+	SessionClosed
+)
+
+// Session is an ongoing `/create_vm` conversation, bound to its thread
+type Session struct {
+	UserID string
+	// ProfileID is the profile of the requester, whose stored SSH keys are used
+	ProfileID string
+	RootID    string
+	ParentID  string
+	ThreadID  string
+	// CoOwners may act on the session like the requester
+	CoOwners []string
+
+	state    SessionState
+	configCh chan *VMSpec
+	cancel   context.CancelFunc
+	lock     sync.Mutex
+}
+
+func NewSession(owner Sender, rootID, parentID, threadID string, coOwners []string, cancel context.CancelFunc) *Session {
+	return &Session{
+		UserID:    owner.UserID,
+		ProfileID: profileID(owner),
+		RootID:    rootID,
+		ParentID:  parentID,
+		ThreadID:  threadID,
+		CoOwners:  coOwners,
+		state:     SessionCollecting,
+		configCh:  make(chan *VMSpec, 1),
+		cancel:    cancel,
+	}
+}
+
+// CanOperate reports whether the user may submit, release or cancel in this
+// session: the requester, a co-owner or an admin
+func (s *Session) CanOperate(userID string) bool {
+	if userID == "" {
+		return false
+	}
+	if userID == s.UserID || isAdmin(userID) {
+		return true
+	}
+	for _, id := range s.CoOwners {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// CanOperateSender is CanOperate for a sender whose user id may be missing.
+// When the app cannot read user ids the requester is matched by profile,
+// which is then the open id.
+func (s *Session) CanOperateSender(sender Sender) bool {
+	if s.CanOperate(sender.UserID) {
+		return true
+	}
+	id := profileID(sender)
+	return id != "" && id == s.ProfileID
+}
+
+// State returns the current stage of the session
+func (s *Session) State() SessionState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state
+}
+
+// Configs delivers the validated spec submitted in the session's thread
+func (s *Session) Configs() <-chan *VMSpec {
+	return s.configCh
+}
+
+// Deliver hands a spec to the session without blocking. It reports false if
+// the session is no longer collecting.
+func (s *Session) Deliver(spec *VMSpec) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.state != SessionCollecting {
+		return false
+	}
+	select {
+	case s.configCh <- spec:
+		s.state = SessionDeploying
+		return true
+	default:
+		return false
+	}
+}
+
+// Cancel ends a session that is still collecting. It reports false if the
+// deployment has already been handed to the scheduler.
+func (s *Session) Cancel() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.state != SessionCollecting {
+		return false
+	}
+	s.state = SessionClosed
+	s.cancel()
+	return true
+}
+
+// SessionRegistry maps thread IDs to their `/create_vm` session
+type SessionRegistry struct {
+	sessions sync.Map
+}
+
+func (r *SessionRegistry) Register(s *Session) {
+	r.sessions.Store(s.ThreadID, s)
+}
+
+func (r *SessionRegistry) Get(threadID string) (*Session, bool) {
+	v, ok := r.sessions.Load(threadID)
+	if !ok {
+		return nil, false
+	}
+	return v.(*Session), true
+}
+
+// GetByParent returns the session started by the message with the given ID,
+// card callbacks only know the message of the card
+func (r *SessionRegistry) GetByParent(messageID string) (*Session, bool) {
+	var found *Session
+	r.sessions.Range(func(_, v any) bool {
+		if s := v.(*Session); s.ParentID == messageID {
+			found = s
+			return false
+		}
+		return true
+	})
+	return found, found != nil
+}
+
+func (r *SessionRegistry) Remove(threadID string) {
+	r.sessions.Delete(threadID)
+}
+
+// Global registry of ongoing `/create_vm` sessions
+var sessions = &SessionRegistry{}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// VMSpec is the user-editable configuration of a VM, it mirrors the
+// variables of terraform/variable.tf that are not owned by the operator.
+// The tfvar tag is the name of the Terraform variable of each field, the
+// spec tag names fields the bot resolves itself.
+type VMSpec struct {
+	SSHUsername  string `tfvar:"ssh_username"`
+	SSHPublicKey string `tfvar:"ssh_public_key"`
+	// SSHPublicKeys are authorized in addition to SSHPublicKey
+	SSHPublicKeys []string `tfvar:"ssh_public_keys"`
+	// ExtraUsers are created next to SSHUsername, set with user.<name>.* keys
+	ExtraUsers  []ExtraUser `tfvar:"extra_users"`
+	Hostname    string      `tfvar:"hostname"`
+	VMName      string      `tfvar:"vm_name"`
+	NumVCPUs    int         `tfvar:"numvcpus"`
+	Memory      int         `tfvar:"memory"`    // MB
+	DiskSize    int         `tfvar:"disk_size"` // GB
+	DiskType    string      `tfvar:"disk_type"`
+	OVFSource   string      `tfvar:"ovf_source"`
+	CloneFromVM string      `tfvar:"clone_from_vm"`
+
+	// Host pins the VM to an ESXi host, empty lets the placement policy choose
+	Host string `spec:"host"`
+	// Image names the catalog image OVFSource is resolved from, empty is the default image
+	Image string `spec:"image"`
+	// Template names the golden VM CloneFromVM is resolved from, it replaces Image
+	Template string `spec:"template"`
+	// Packages, RunCmd and WriteFiles are merged into the cloud-config after
+	// the operator's base snippet and the CloudInitProfiles, see CloudInitConfig
+	Packages          []string `spec:"packages"`
+	RunCmd            []string `spec:"runcmd"`
+	CloudInitProfiles []string `spec:"profiles"`
+	// WriteFiles are set with file.<name>.* keys
+	WriteFiles []WriteFile
+}
+
+// Keys whose empty value means unset, so `template = ""` from the example
+// config picks no template and `host = ""` lets the placement policy choose
+var optionalKeys = []string{"flavor", "template", "image", "host"}
+
+// Variables the bot resolves from other keys, users cannot set them directly
+var resolvedKeys = map[string]string{
+	"ovf_source":    "use image = <name> instead, see /images",
+	"clone_from_vm": "use template = <name> instead, see /template list",
+	"write_files":   "use file.<name>.path and file.<name>.content keys instead",
+}
+
+// ExtraUser is an additional user account created by cloud-init
+type ExtraUser struct {
+	Name          string   `tfvar:"name"`
+	Sudo          bool     `tfvar:"sudo"`
+	SSHPublicKeys []string `tfvar:"ssh_public_keys"`
+}
+
+// Maximum number of extra users per VM
+const maxExtraUsers = 10
+
+// Limits enforced on every spec
+const (
+	minVCPUs    = 1
+	maxVCPUs    = 32
+	minMemory   = 512 // MB
+	maxMemory   = 65536
+	minDiskSize = 1 // GB
+	maxDiskSize = 2048
+)
+
+var (
+	hostnamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+	vmNamePattern   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,79}$`)
+	usernamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+)
+
+// Public key algorithms accepted in ssh_public_key
+var sshKeyTypes = map[string]bool{
+	"ssh-rsa":                            true,
+	"ssh-dss":                            true,
+	"ssh-ed25519":                        true,
+	"ecdsa-sha2-nistp256":                true,
+	"ecdsa-sha2-nistp384":                true,
+	"ecdsa-sha2-nistp521":                true,
+	"sk-ssh-ed25519@openssh.com":         true,
+	"sk-ecdsa-sha2-nistp256@openssh.com": true,
+}
+
+// DefaultVMSpec returns a spec holding the defaults of terraform/variable.tf
+// and the default image of the catalog
+func DefaultVMSpec() *VMSpec {
+	spec := &VMSpec{
+		SSHUsername: "ubuntu",
+		Hostname:    "sast-vm",
+		VMName:      "vm",
+		NumVCPUs:    2,
+		Memory:      2048,
+		DiskSize:    10,
+		DiskType:    "thin",
+		OVFSource:   "jammy-server-cloudimg-amd64.ova",
+	}
+	if Images != nil {
+		img, _ := Images.Get("")
+		spec.Image = img.Name
+		spec.OVFSource = img.OVFSource
+	}
+	return spec
+}
+
+// SpecErrors lists every problem found in a configuration, one per line
+type SpecErrors []string
+
+func (e SpecErrors) Error() string {
+	return strings.Join(e, "\n")
+}
+
+// ParseVMSpec builds a spec for the VM owner from a parsed configuration on
+// top of the defaults and validates it. A template key sets the defaults of
+// the golden VM first, then a flavor key sets the size, explicit numvcpus,
+// memory and disk_size override both. Without any SSH key
+// the keys stored in the owner's profile are used. All problems are reported
+// at once as SpecErrors.
+func ParseVMSpec(owner string, config map[string]string) (*VMSpec, error) {
+	spec := DefaultVMSpec()
+	var errs SpecErrors
+	for _, key := range optionalKeys {
+		if value, ok := config[key]; ok && value == "" {
+			config = withoutKey(config, key)
+		}
+	}
+	var tpl *Template
+	if name, ok := config["template"]; ok {
+		config = withoutKey(config, "template")
+		var err error
+		if tpl, err = templates.Get(name); err == nil {
+			tpl.Apply(spec)
+			spec.Template = tpl.Name
+		} else {
+			errs = append(errs, fmt.Sprintf("template: unknown template %q, available: %s", name, templateNames()))
+		}
+	}
+	if name, ok := config["flavor"]; ok {
+		config = withoutKey(config, "flavor")
+		if flavor, ok := Flavors[name]; ok {
+			flavor.Apply(spec)
+		} else {
+			errs = append(errs, fmt.Sprintf("flavor: unknown flavor %q, available: %s", name, flavorNames()))
+		}
+	}
+	config, userErrs := spec.applyExtraUsers(config)
+	errs = append(errs, userErrs...)
+	config, fileErrs := spec.applyWriteFiles(config)
+	errs = append(errs, fileErrs...)
+	errs = append(errs, spec.apply(config)...)
+	if tpl != nil {
+		// Clones are placed on the host of the golden VM and keep its disk
+		spec.CloneFromVM = tpl.VMName
+		spec.OVFSource = ""
+		if _, ok := config["image"]; ok {
+			errs = append(errs, "image: cannot be combined with template")
+		}
+		spec.Image = ""
+		if spec.Host == "" {
+			spec.Host = tpl.Host
+		} else if spec.Host != tpl.Host {
+			errs = append(errs, fmt.Sprintf("host: template %q can only be cloned on host %q", tpl.Name, tpl.Host))
+		}
+	} else if Images != nil {
+		if img, ok := Images.Get(spec.Image); ok {
+			spec.Image = img.Name
+			spec.OVFSource = img.OVFSource
+			if _, ok := config["ssh_username"]; !ok && img.DefaultUser != "" {
+				spec.SSHUsername = img.DefaultUser
+			}
+		} else {
+			errs = append(errs, fmt.Sprintf("image: unknown image %q, available: %s", spec.Image, strings.Join(Images.Names(), ", ")))
+		}
+	}
+	if spec.SSHPublicKey == "" && len(spec.SSHPublicKeys) == 0 && profiles != nil {
+		profile, err := profiles.Get(owner)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("ssh_public_key: failed to load stored keys: %v", err))
+		} else {
+			spec.SSHPublicKeys = profile.AuthorizedKeys()
+		}
+	}
+	errs = append(errs, spec.Validate()...)
+	if len(errs) == 0 && CloudInit != nil {
+		if _, err := CloudInit.Render(spec); err != nil {
+			errs = append(errs, fmt.Sprintf("cloud-init: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return spec, nil
+}
+
+// hostnameFromVMName sets the hostname of a configuration without one to its
+// vm_name in lowercase, when that is a valid hostname
+func hostnameFromVMName(config map[string]string) {
+	if _, ok := config["hostname"]; ok {
+		return
+	}
+	if hostname := strings.ToLower(config["vm_name"]); hostnamePattern.MatchString(hostname) {
+		config["hostname"] = hostname
+	}
+}
+
+// withoutKey returns a copy of config without key
+func withoutKey(config map[string]string, key string) map[string]string {
+	out := make(map[string]string, len(config))
+	for k, v := range config {
+		if k != key {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// applyExtraUsers collects the user.<name>.sudo, user.<name>.ssh_public_key
+// and user.<name>.ssh_public_keys keys into ExtraUsers, in name order. It
+// returns the configuration without those keys.
+func (s *VMSpec) applyExtraUsers(config map[string]string) (map[string]string, SpecErrors) {
+	var errs SpecErrors
+	users := make(map[string]*ExtraUser)
+	rest := make(map[string]string)
+	for key, value := range config {
+		parts := strings.SplitN(key, ".", 3)
+		if parts[0] != "user" {
+			rest[key] = value
+			continue
+		}
+		if len(parts) != 3 {
+			errs = append(errs, fmt.Sprintf("%s: expected user.<name>.sudo, user.<name>.ssh_public_key or user.<name>.ssh_public_keys", key))
+			continue
+		}
+		user, ok := users[parts[1]]
+		if !ok {
+			user = &ExtraUser{Name: parts[1]}
+			users[parts[1]] = user
+		}
+		switch parts[2] {
+		case "sudo":
+			sudo, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not true or false", key, value))
+				continue
+			}
+			user.Sudo = sudo
+		case "ssh_public_key":
+			user.SSHPublicKeys = append(user.SSHPublicKeys, value)
+		case "ssh_public_keys":
+			list, err := parseStringList(value)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+				continue
+			}
+			user.SSHPublicKeys = append(user.SSHPublicKeys, list...)
+		default:
+			errs = append(errs, fmt.Sprintf("%s: unknown user setting %q", key, parts[2]))
+		}
+	}
+	for _, name := range sortedKeys(users) {
+		s.ExtraUsers = append(s.ExtraUsers, *users[name])
+	}
+	return rest, errs
+}
+
+// applyWriteFiles collects the file.<name>.path, file.<name>.content and
+// file.<name>.permissions keys into WriteFiles, in name order. Escapes such
+// as \n in the content are interpreted. It returns the configuration without
+// those keys.
+func (s *VMSpec) applyWriteFiles(config map[string]string) (map[string]string, SpecErrors) {
+	var errs SpecErrors
+	files := make(map[string]*WriteFile)
+	rest := make(map[string]string)
+	for key, value := range config {
+		parts := strings.SplitN(key, ".", 3)
+		if parts[0] != "file" {
+			rest[key] = value
+			continue
+		}
+		if len(parts) != 3 {
+			errs = append(errs, fmt.Sprintf("%s: expected file.<name>.path, file.<name>.content or file.<name>.permissions", key))
+			continue
+		}
+		file, ok := files[parts[1]]
+		if !ok {
+			file = &WriteFile{}
+			files[parts[1]] = file
+		}
+		switch parts[2] {
+		case "path":
+			file.Path = value
+		case "content":
+			if unquoted, err := strconv.Unquote(`"` + value + `"`); err == nil {
+				value = unquoted
+			}
+			file.Content = value
+		case "permissions":
+			file.Permissions = value
+		default:
+			errs = append(errs, fmt.Sprintf("%s: unknown file setting %q", key, parts[2]))
+		}
+	}
+	if len(files) > maxWriteFiles {
+		errs = append(errs, fmt.Sprintf("file: at most %d files are allowed", maxWriteFiles))
+	}
+	for _, name := range sortedKeys(files) {
+		if err := files[name].validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("file.%s: %v", name, err))
+			continue
+		}
+		s.WriteFiles = append(s.WriteFiles, *files[name])
+	}
+	return rest, errs
+}
+
+// apply sets the fields named by the configuration keys, in key order
+func (s *VMSpec) apply(config map[string]string) SpecErrors {
+	var errs SpecErrors
+	fields := specKeyFields(reflect.TypeOf(*s))
+	v := reflect.ValueOf(s).Elem()
+
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := config[key]
+		if hint, ok := resolvedKeys[key]; ok {
+			errs = append(errs, fmt.Sprintf("%s: cannot be set, %s", key, hint))
+			continue
+		}
+		if isOperatorVar(key) {
+			errs = append(errs, fmt.Sprintf("%s: is managed by the operator and cannot be set", key))
+			continue
+		}
+		i, ok := fields[key]
+		if !ok {
+			msg := fmt.Sprintf("%s: unknown key", key)
+			if guess := closestKey(key, fields); guess != "" {
+				msg += fmt.Sprintf(", did you mean %s?", guess)
+			}
+			errs = append(errs, msg)
+			continue
+		}
+
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not a whole number", key, value))
+				continue
+			}
+			field.SetInt(int64(n))
+		case reflect.Slice:
+			if field.Type() != reflect.TypeOf([]string(nil)) {
+				errs = append(errs, fmt.Sprintf("%s: cannot be set directly, use user.<name>.* keys", key))
+				continue
+			}
+			list, err := parseStringList(value)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+				continue
+			}
+			field.Set(reflect.ValueOf(list))
+		}
+	}
+	return errs
+}
+
+// parseStringList parses a list of quoted strings such as ["a", "b"]
+func parseStringList(value string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+		return nil, fmt.Errorf("expected a list like [\"a\", \"b\"]")
+	}
+	var list []string
+	rest := strings.TrimSpace(value[1 : len(value)-1])
+	for rest != "" {
+		item, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return nil, fmt.Errorf("expected a quoted string at %q", rest)
+		}
+		s, _ := strconv.Unquote(item)
+		list = append(list, s)
+		rest = strings.TrimSpace(rest[len(item):])
+		if rest != "" {
+			if rest[0] != ',' {
+				return nil, fmt.Errorf("expected ',' at %q", rest)
+			}
+			rest = strings.TrimSpace(rest[1:])
+		}
+	}
+	return list, nil
+}
+
+// Validate checks types, ranges and formats of the spec
+func (s *VMSpec) Validate() SpecErrors {
+	var errs SpecErrors
+	if s.NumVCPUs < minVCPUs || s.NumVCPUs > maxVCPUs {
+		errs = append(errs, fmt.Sprintf("numvcpus: must be between %d and %d, got %d", minVCPUs, maxVCPUs, s.NumVCPUs))
+	}
+	if s.Memory < minMemory || s.Memory > maxMemory {
+		errs = append(errs, fmt.Sprintf("memory: must be between %d and %d MB, got %d", minMemory, maxMemory, s.Memory))
+	}
+	if s.DiskSize < minDiskSize || s.DiskSize > maxDiskSize {
+		errs = append(errs, fmt.Sprintf("disk_size: must be between %d and %d GB, got %d", minDiskSize, maxDiskSize, s.DiskSize))
+	}
+	if s.DiskType != "thin" && s.DiskType != "thick" {
+		errs = append(errs, fmt.Sprintf("disk_type: must be thin or thick, got %q", s.DiskType))
+	}
+	if !hostnamePattern.MatchString(s.Hostname) {
+		errs = append(errs, fmt.Sprintf("hostname: %q is not a valid hostname (lowercase letters, digits and '-', at most 63 characters)", s.Hostname))
+	}
+	if !vmNamePattern.MatchString(s.VMName) {
+		errs = append(errs, fmt.Sprintf("vm_name: %q is not a valid name (letters, digits, '.', '_' and '-', at most 80 characters)", s.VMName))
+	}
+	if !usernamePattern.MatchString(s.SSHUsername) {
+		errs = append(errs, fmt.Sprintf("ssh_username: %q is not a valid user name", s.SSHUsername))
+	}
+	if s.SSHPublicKey != "" || len(s.SSHPublicKeys) == 0 {
+		if err := validateSSHPublicKey(s.SSHPublicKey); err != nil {
+			errs = append(errs, fmt.Sprintf("ssh_public_key: %v (or store one with /ssh_key add)", err))
+		}
+	}
+	for i, key := range s.SSHPublicKeys {
+		if err := validateSSHPublicKey(key); err != nil {
+			errs = append(errs, fmt.Sprintf("ssh_public_keys[%d]: %v", i, err))
+		}
+	}
+	if len(s.ExtraUsers) > maxExtraUsers {
+		errs = append(errs, fmt.Sprintf("user: at most %d extra users are allowed, got %d", maxExtraUsers, len(s.ExtraUsers)))
+	}
+	for _, user := range s.ExtraUsers {
+		if !usernamePattern.MatchString(user.Name) || user.Name == s.SSHUsername || user.Name == "root" {
+			errs = append(errs, fmt.Sprintf("user.%s: %q is not a valid extra user name", user.Name, user.Name))
+		}
+		if len(user.SSHPublicKeys) == 0 {
+			errs = append(errs, fmt.Sprintf("user.%s: needs at least one ssh_public_key", user.Name))
+		}
+		for i, key := range user.SSHPublicKeys {
+			if err := validateSSHPublicKey(key); err != nil {
+				errs = append(errs, fmt.Sprintf("user.%s.ssh_public_keys[%d]: %v", user.Name, i, err))
+			}
+		}
+	}
+	if s.Host != "" && Hosts != nil {
+		if _, ok := Hosts.Get(s.Host); !ok {
+			errs = append(errs, fmt.Sprintf("host: unknown host %q, available: %s", s.Host, strings.Join(Hosts.Names(), ", ")))
+		}
+	}
+	errs = append(errs, validatePackages("packages", s.Packages)...)
+	errs = append(errs, validateRunCmd("runcmd", s.RunCmd)...)
+	if CloudInit != nil {
+		for i, name := range s.CloudInitProfiles {
+			if _, ok := CloudInit.Profiles[name]; !ok {
+				errs = append(errs, fmt.Sprintf("profiles[%d]: unknown profile %q, available: %s", i, name, CloudInit.ProfileNames()))
+			}
+		}
+	}
+	if s.OVFSource == "" && s.CloneFromVM == "" {
+		errs = append(errs, "image: is required unless template is set")
+	}
+	return errs
+}
+
+// Vars returns the spec as Terraform variable values keyed by variable name
+func (s *VMSpec) Vars() map[string]interface{} {
+	return tfvarValues(s)
+}
+
+// ExampleConfig renders the spec as a configuration users can edit and send back
+func (s *VMSpec) ExampleConfig() string {
+	var b strings.Builder
+	v := reflect.ValueOf(s).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := specKey(t.Field(i))
+		if _, resolved := resolvedKeys[name]; name == "" || resolved {
+			continue
+		}
+		value := v.Field(i).Interface()
+		if _, ok := value.([]ExtraUser); ok {
+			continue
+		}
+		// Unset optional keys are left out
+		if value == "" && slices.Contains(optionalKeys, name) {
+			continue
+		}
+		if str, ok := value.(string); ok {
+			value = strconv.Quote(str)
+		}
+		// The default image applies anyway and excludes template, so it is
+		// only shown as a hint
+		if name == "image" {
+			fmt.Fprintf(&b, "# %-13s = %v (or template = <name>, see /template)\n", name, value)
+			continue
+		}
+		fmt.Fprintf(&b, "%-15s = %v\n", name, value)
+	}
+	return b.String()
+}
+
+// specKeyFields maps the configuration keys users may set to the field
+// indexes of a struct type, from the tfvar and spec tags
+func specKeyFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		if name := specKey(t.Field(i)); name != "" {
+			fields[name] = i
+		}
+	}
+	return fields
+}
+
+// specKey returns the configuration key of a struct field
+func specKey(f reflect.StructField) string {
+	if name := f.Tag.Get("tfvar"); name != "" {
+		return name
+	}
+	return f.Tag.Get("spec")
+}
+
+// tfvarValues returns the tagged fields of a struct pointer keyed by variable name
+func tfvarValues(s interface{}) map[string]interface{} {
+	return structVars(reflect.ValueOf(s).Elem())
+}
+
+// tfvarFields maps Terraform variable names to the field indexes of a struct
+// type, from the tfvar tags
+func tfvarFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Tag.Get("tfvar"); name != "" {
+			fields[name] = i
+		}
+	}
+	return fields
+}
+
+// validateSSHPublicKey checks a key in authorized_keys format: type, base64
+// blob and optional comment, the blob must encode the same key type
+func validateSSHPublicKey(key string) error {
+	parts := strings.Fields(key)
+	if len(parts) < 2 {
+		return fmt.Errorf("is required, in the form \"ssh-ed25519 AAAA... comment\"")
+	}
+	if !sshKeyTypes[parts[0]] {
+		return fmt.Errorf("unsupported key type %q", parts[0])
+	}
+	blob, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("key data is not valid base64")
+	}
+	// The blob starts with the key type as a length-prefixed string
+	if len(blob) < 4 {
+		return fmt.Errorf("key data is truncated")
+	}
+	n := binary.BigEndian.Uint32(blob)
+	if uint64(len(blob)) < 4+uint64(n) || !bytes.Equal(blob[4:4+n], []byte(parts[0])) {
+		return fmt.Errorf("key data does not match key type %s", parts[0])
+	}
+	return nil
+}
+
+// sshKeyFingerprint returns the SHA256 fingerprint of a public key, in the
+// format printed by ssh-keygen -l
+func sshKeyFingerprint(key string) (string, error) {
+	parts := strings.Fields(key)
+	if len(parts) < 2 {
+		return "", fmt.Errorf("invalid public key")
+	}
+	blob, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("key data is not valid base64")
+	}
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]), nil
+}
+
+// closestKey returns the known key within two edits of key, if any
+func closestKey(key string, fields map[string]int) string {
+	best, bestDist := "", 3
+	for name := range fields {
+		if d := editDistance(key, name); d < bestDist || (d == bestDist && best != "" && name < best) {
+			best, bestDist = name, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Files copied into every workspace. They are copied rather than linked so
+// an existing VM keeps the exact configuration it was created with, even
+// after the templates in the repository change.
+var workspaceFiles = map[string]string{
+	"terraform/main.tf":             "main.tf",
+	"terraform/variable.tf":         "variable.tf",
+	"terraform/.terraform.lock.hcl": ".terraform.lock.hcl",
+	"cloud-init/userdata.yaml":      "userdata.yaml",
+}
+
+// Directories linked into every workspace, the provider cache is shared
+var workspaceLinks = map[string]string{
+	"terraform/.terraform": ".terraform",
+}
+
+// workspacePath returns the Terraform working directory of a VM
+func workspacePath(vmID string) string {
+	return filepath.Join(StateDir, vmID)
+}
+
+// prepareWorkspace creates the working directory of a VM under StateDir.
+// Workspaces hold the state and the saved plans, so only the bot may read them.
+func prepareWorkspace(vmID string) (string, error) {
+	dirPath := workspacePath(vmID)
+	if err := os.MkdirAll(dirPath, 0700); err != nil {
+		return "", fmt.Errorf("failed to create directory %s: %w", dirPath, err)
+	}
+
+	for src, dest := range workspaceFiles {
+		if err := copyFile(src, filepath.Join(dirPath, dest)); err != nil {
+			return "", fmt.Errorf("failed to copy %s: %w", src, err)
+		}
+	}
+	for src, dest := range workspaceLinks {
+		absSrc, err := filepath.Abs(src)
+		if err != nil {
+			return "", fmt.Errorf("failed to get absolute path for %s: %w", src, err)
+		}
+		if err := createSymlink(absSrc, filepath.Join(dirPath, dest)); err != nil {
+			return "", err
+		}
+	}
+	return dirPath, nil
+}
+
+// cleanupWorkspaces restricts StateDir and the existing workspaces to the
+// bot and removes what a restart leaves behind: plan files, which hold
+// credentials and are never applied after a restart, and the workspaces of
+// plans that were never applied, which have no inventory record and no
+// resources. Called in main once the inventory is loaded.
+func cleanupWorkspaces() error {
+	records, err := inventory.List()
+	if err != nil {
+		return fmt.Errorf("failed to list VMs: %w", err)
+	}
+	recorded := make(map[string]bool)
+	for _, rec := range records {
+		recorded[filepath.Clean(rec.Workspace)] = true
+	}
+
+	entries, err := os.ReadDir(StateDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read state directory: %w", err)
+	}
+	if err := os.Chmod(StateDir, 0700); err != nil {
+		return fmt.Errorf("failed to protect state directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dirPath := filepath.Join(StateDir, entry.Name())
+		if err := os.Chmod(dirPath, 0700); err != nil {
+			return fmt.Errorf("failed to protect workspace %s: %w", dirPath, err)
+		}
+		err := os.Remove(filepath.Join(dirPath, planFile))
+		if err == nil {
+			fmt.Println("Removed stale plan file in", dirPath)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove stale plan file: %w", err)
+		}
+		if recorded[filepath.Clean(dirPath)] {
+			continue
+		}
+		// A workspace still managing resources is kept, they must be destroyed by hand
+		if err := removeWorkspace(dirPath); err != nil {
+			fmt.Println("Keeping workspace without inventory record:", err)
+			continue
+		}
+		fmt.Println("Removed workspace without inventory record", dirPath)
+	}
+	return nil
+}
+
+// removeWorkspace deletes a workspace unless its state still tracks resources,
+// in which case it is kept so the resources can be destroyed later
+func removeWorkspace(dirPath string) error {
+	managed, err := hasManagedResources(dirPath)
+	if err != nil {
+		return err
+	}
+	if managed {
+		return fmt.Errorf("workspace %s still manages resources, keeping it", dirPath)
+	}
+	return os.RemoveAll(dirPath)
+}
+
+// hasManagedResources reports whether the workspace's terraform.tfstate
+// contains any resources
+func hasManagedResources(dirPath string) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(dirPath, "terraform.tfstate"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read terraform state: %w", err)
+	}
+
+	var state struct {
+		Resources []json.RawMessage `json:"resources"`
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return false, fmt.Errorf("failed to parse terraform state: %w", err)
+	}
+	return len(state.Resources) > 0, nil
+}
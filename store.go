@@ -1,13 +1,173 @@
 package main
 
-import "sync"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
 
-type TopicInfo struct {
-	UserID   string
-	RootID   string
-	ParentID string
-	ThreadID string
+// VMRecord describes a VM created by the bot
+type VMRecord struct {
+	ID       string `json:"id"`
+	Name     string `json:"vm_name"`
+	Hostname string `json:"hostname"`
+	Owner    string `json:"owner"`
+	ThreadID string `json:"thread_id"`
+	NumVCPUs int    `json:"numvcpus"`
+	Memory   int    `json:"memory"`    // MB
+	DiskSize int    `json:"disk_size"` // GB
+	DiskType string `json:"disk_type"`
+	// Host is the name of the ESXi host the VM was placed on
+	Host  string `json:"host"`
+	Image string `json:"image"`
+	// Template is the golden VM the VM was cloned from, if any
+	Template  string    `json:"template,omitempty"`
+	IPs       []string  `json:"ips"`
+	CreatedAt time.Time `json:"created_at"`
+	// Workspace is the Terraform working directory holding the VM's state
+	Workspace string `json:"workspace"`
+	// Status is empty for a VM that was created, VMStatusFailed for one
+	// whose creation failed after Terraform already created resources
+	Status string `json:"status,omitempty"`
 }
 
-// Global map to store ongoing `/create_vm` topics
-var activeTopics sync.Map
+// VMStatusFailed marks a half-created VM, it still counts against quotas and
+// host capacity until it is removed with /destroy_vm
+const VMStatusFailed = "failed"
+
+var ErrVMNotFound = errors.New("vm not found")
+
+// VMStore is the inventory of VMs created by the bot
+type VMStore interface {
+	// Add inserts or replaces a record, keyed by its ID
+	Add(rec *VMRecord) error
+	// GetByName returns the record with the given vm_name
+	GetByName(name string) (*VMRecord, error)
+	// List returns all records ordered by creation time
+	List() ([]*VMRecord, error)
+	// ListByOwner returns the records owned by the given user
+	ListByOwner(owner string) ([]*VMRecord, error)
+	// Delete removes the record with the given ID
+	Delete(id string) error
+}
+
+// Global VM inventory, initialized in main
+var inventory VMStore
+
+// fileStore is a VMStore persisted as a JSON file
+type fileStore struct {
+	path    string
+	lock    sync.RWMutex
+	records map[string]*VMRecord
+}
+
+// NewFileStore opens the JSON inventory at path, creating it if needed
+func NewFileStore(path string) (VMStore, error) {
+	s := &fileStore{path: path, records: make(map[string]*VMRecord)}
+	records, err := loadJSONList[*VMRecord](path, "inventory")
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range records {
+		s.records[rec.ID] = rec
+	}
+	return s, nil
+}
+
+func (s *fileStore) Add(rec *VMRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.records[rec.ID] = rec
+	return s.save()
+}
+
+func (s *fileStore) GetByName(name string) (*VMRecord, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, rec := range s.records {
+		if rec.Name == name {
+			return rec, nil
+		}
+	}
+	return nil, ErrVMNotFound
+}
+
+func (s *fileStore) List() ([]*VMRecord, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.sorted(func(*VMRecord) bool { return true }), nil
+}
+
+func (s *fileStore) ListByOwner(owner string) ([]*VMRecord, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.sorted(func(rec *VMRecord) bool { return rec.Owner == owner }), nil
+}
+
+func (s *fileStore) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.records[id]; !ok {
+		return ErrVMNotFound
+	}
+	delete(s.records, id)
+	return s.save()
+}
+
+// sorted returns the records matching keep, oldest first. Caller must hold the lock.
+func (s *fileStore) sorted(keep func(*VMRecord) bool) []*VMRecord {
+	var records []*VMRecord
+	for _, rec := range s.records {
+		if keep(rec) {
+			records = append(records, rec)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+	return records
+}
+
+// save writes the inventory. Caller must hold the lock.
+func (s *fileStore) save() error {
+	return saveJSONList(s.path, "inventory", s.sorted(func(*VMRecord) bool { return true }))
+}
+
+// loadJSONList reads the JSON array a file store keeps at path, a missing
+// file is an empty store. what names the store in errors.
+func loadJSONList[T any](path, what string) ([]T, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %s %s: %w", what, path, err)
+	}
+	var list []T
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse %s %s: %w", what, path, err)
+	}
+	return list, nil
+}
+
+// saveJSONList writes the JSON array of a file store to a temp file and
+// renames it over the old one, so a crash never leaves a half-written file
+func saveJSONList[T any](path, what string, list []T) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create %s directory: %w", what, err)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", what, err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", what, err)
+	}
+	return os.Rename(tmp, path)
+}
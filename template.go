@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Template is a golden VM users can clone from by its friendly name
+type Template struct {
+	Name string `json:"name"`
+	// VMName is the ESXi guest name passed to clone_from_vm
+	VMName string `json:"vm_name"`
+	// Host is the ESXi host the golden VM lives on, clones are placed there
+	Host        string `json:"host"`
+	Description string `json:"description"`
+	// Default specs of clones, explicit keys in the configuration override them
+	NumVCPUs     int       `json:"numvcpus"`
+	Memory       int       `json:"memory"`    // MB
+	DiskSize     int       `json:"disk_size"` // GB
+	SSHUsername  string    `json:"ssh_username"`
+	RegisteredBy string    `json:"registered_by"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Apply sets the default specs of the template on the spec
+func (t *Template) Apply(spec *VMSpec) {
+	spec.NumVCPUs = t.NumVCPUs
+	spec.Memory = t.Memory
+	spec.DiskSize = t.DiskSize
+	if t.SSHUsername != "" {
+		spec.SSHUsername = t.SSHUsername
+	}
+}
+
+func (t *Template) String() string {
+	s := fmt.Sprintf("%s: clone of %s on %s, %d vCPU / %d MB / %d GB", t.Name, t.VMName, t.Host, t.NumVCPUs, t.Memory, t.DiskSize)
+	if t.Description != "" {
+		s += " - " + t.Description
+	}
+	return s
+}
+
+var (
+	ErrTemplateExists   = errors.New("template already exists")
+	ErrTemplateNotFound = errors.New("template not found")
+)
+
+// TemplateStore persists the catalog of golden VMs
+type TemplateStore interface {
+	// Get returns the template with the given name
+	Get(name string) (*Template, error)
+	// GetByVMName returns the template cloned from the given ESXi guest
+	GetByVMName(vmName string) (*Template, error)
+	// List returns all templates ordered by name
+	List() ([]*Template, error)
+	// Add stores a new template, names are unique
+	Add(t *Template) error
+	// Remove deletes the template with the given name
+	Remove(name string) error
+}
+
+// Global template catalog, initialized in main
+var templates TemplateStore
+
+// templateFileStore is a TemplateStore persisted as a JSON file
+type templateFileStore struct {
+	path      string
+	lock      sync.RWMutex
+	templates map[string]*Template
+}
+
+// NewTemplateFileStore opens the JSON template catalog at path, creating it if needed
+func NewTemplateFileStore(path string) (TemplateStore, error) {
+	s := &templateFileStore{path: path, templates: make(map[string]*Template)}
+	list, err := loadJSONList[*Template](path, "templates")
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range list {
+		s.templates[t.Name] = t
+	}
+	return s, nil
+}
+
+func (s *templateFileStore) Get(name string) (*Template, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	t, ok := s.templates[name]
+	if !ok {
+		return nil, ErrTemplateNotFound
+	}
+	cp := *t
+	return &cp, nil
+}
+
+func (s *templateFileStore) GetByVMName(vmName string) (*Template, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, t := range s.templates {
+		if t.VMName == vmName {
+			cp := *t
+			return &cp, nil
+		}
+	}
+	return nil, ErrTemplateNotFound
+}
+
+func (s *templateFileStore) List() ([]*Template, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	list := make([]*Template, 0, len(s.templates))
+	for _, name := range sortedKeys(s.templates) {
+		cp := *s.templates[name]
+		list = append(list, &cp)
+	}
+	return list, nil
+}
+
+func (s *templateFileStore) Add(t *Template) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.templates[t.Name]; ok {
+		return ErrTemplateExists
+	}
+	cp := *t
+	s.templates[t.Name] = &cp
+	return s.save()
+}
+
+func (s *templateFileStore) Remove(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.templates[name]; !ok {
+		return ErrTemplateNotFound
+	}
+	delete(s.templates, name)
+	return s.save()
+}
+
+// save writes the templates ordered by name. Caller must hold the lock.
+func (s *templateFileStore) save() error {
+	list := make([]*Template, 0, len(s.templates))
+	for _, name := range sortedKeys(s.templates) {
+		list = append(list, s.templates[name])
+	}
+	return saveJSONList(s.path, "templates", list)
+}
+
+// Options of /template register describing a guest the bot did not create
+var templateOptions = []string{"host", "numvcpus", "memory", "disk_size"}
+
+// newTemplate builds a template from an existing VM. A VM in the inventory
+// gives the host and default specs. Any other ESXi guest is described by
+// host=, numvcpus=, memory= and disk_size= options among args, host is
+// required unless only one host is configured and the specs default to
+// those of DefaultVMSpec. The bot cannot see the guests of a host, so the
+// options must match the guest.
+func newTemplate(vmName string, args []string, registeredBy string) (*Template, error) {
+	defaults := DefaultVMSpec()
+	tpl := &Template{
+		Name:         vmName,
+		VMName:       vmName,
+		NumVCPUs:     defaults.NumVCPUs,
+		Memory:       defaults.Memory,
+		DiskSize:     defaults.DiskSize,
+		RegisteredBy: registeredBy,
+		CreatedAt:    time.Now(),
+	}
+	var words []string
+	options := make(map[string]string)
+	for _, arg := range args {
+		if key, value, ok := strings.Cut(arg, "="); ok && slices.Contains(templateOptions, key) {
+			options[key] = value
+			continue
+		}
+		words = append(words, arg)
+	}
+	if len(words) > 0 {
+		tpl.Name = words[0]
+		tpl.Description = strings.Join(words[1:], " ")
+	}
+	if !vmNamePattern.MatchString(tpl.Name) {
+		return nil, fmt.Errorf("invalid template name %q", tpl.Name)
+	}
+
+	rec, err := inventory.GetByName(vmName)
+	switch {
+	case err == nil && rec.Status == VMStatusFailed:
+		return nil, fmt.Errorf("VM %s was only partially created and cannot be a template", vmName)
+	case err == nil && len(options) > 0:
+		return nil, fmt.Errorf("VM %s is in the inventory, its host and specs are taken from there", vmName)
+	case err == nil:
+		tpl.Host = rec.Host
+		tpl.NumVCPUs = rec.NumVCPUs
+		tpl.Memory = rec.Memory
+		tpl.DiskSize = rec.DiskSize
+	case errors.Is(err, ErrVMNotFound):
+		if err := tpl.applyOptions(options); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	return tpl, nil
+}
+
+// applyOptions sets the host and specs of a guest outside the inventory
+func (t *Template) applyOptions(options map[string]string) error {
+	name, ok := options["host"]
+	if !ok && len(Hosts.Names()) > 1 {
+		return fmt.Errorf("VM %s is not in the inventory, give its host with host=<name>, hosts: %s", t.VMName, strings.Join(Hosts.Names(), ", "))
+	}
+	host, ok := Hosts.Get(name)
+	if !ok {
+		return fmt.Errorf("unknown host %q, hosts: %s", name, strings.Join(Hosts.Names(), ", "))
+	}
+	t.Host = host.Name
+	for key, field := range map[string]*int{"numvcpus": &t.NumVCPUs, "memory": &t.Memory, "disk_size": &t.DiskSize} {
+		value, ok := options[key]
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("%s: %s is not a positive whole number", key, value)
+		}
+		*field = n
+	}
+	return nil
+}
+
+// templateNames returns the names of all templates
+func templateNames() string {
+	list, err := templates.List()
+	if err != nil || len(list) == 0 {
+		return "none"
+	}
+	names := make([]string, len(list))
+	for i, t := range list {
+		names[i] = t.Name
+	}
+	return strings.Join(names, ", ")
+}
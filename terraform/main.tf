@@ -39,9 +39,11 @@ resource "esxi_guest" "vm" {
 
   guestinfo = {
     "userdata" = base64encode(templatefile("${path.module}/userdata.yaml", {
-      ssh_username   = var.ssh_username
-      hostname       = var.hostname
-      ssh_public_key = var.ssh_public_key
+      ssh_username    = var.ssh_username
+      hostname        = var.hostname
+      ssh_public_keys = compact(concat([var.ssh_public_key], var.ssh_public_keys, var.team_ssh_keys))
+      extra_users     = var.extra_users
+      cloud_config    = var.cloud_config
     }))
     "userdata.encoding" = "base64"
   }
@@ -97,4 +97,33 @@ variable "network_name" {
 variable "ssh_public_key" {
   description = "SSH public key for the VM user"
   type        = string
+  default     = ""
+}
+
+variable "ssh_public_keys" {
+  description = "Additional SSH public keys for the VM user"
+  type        = list(string)
+  default     = []
+}
+
+variable "team_ssh_keys" {
+  description = "SSH public keys shared by the team, authorized for the VM user"
+  type        = list(string)
+  default     = []
+}
+
+variable "extra_users" {
+  description = "Additional users with their own SSH public keys"
+  type = list(object({
+    name            = string
+    sudo            = bool
+    ssh_public_keys = list(string)
+  }))
+  default = []
+}
+
+variable "cloud_config" {
+  description = "Cloud-config modules merged by the bot: timezone, apt, packages, write_files and runcmd"
+  type        = string
+  default     = ""
 }
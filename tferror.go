@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Xunop/SAST-VMCreator/tfrunner"
+)
+
+// maxDiagnosticDetail is the number of characters of a diagnostic's detail shown in the thread
+const maxDiagnosticDetail = 500
+
+// TerraformError is a failed Terraform command with the diagnostics it
+// reported and its redacted output
+type TerraformError struct {
+	Command     string
+	Err         error
+	Diagnostics []tfrunner.Diagnostic
+	Log         []byte
+}
+
+func (e *TerraformError) Error() string {
+	if len(e.Diagnostics) > 0 {
+		return fmt.Sprintf("terraform %s: %s", e.Command, e.Diagnostics[0].Summary)
+	}
+	return fmt.Sprintf("terraform %s: %v", e.Command, e.Err)
+}
+
+func (e *TerraformError) Unwrap() error {
+	return e.Err
+}
+
+// failureCauses map patterns found in Terraform errors to what the requester can do about them
+var failureCauses = []struct {
+	pattern *regexp.Regexp
+	cause   string
+}{
+	{regexp.MustCompile(`(?i)already exists|duplicate (guest|vm) name|name .* is (already )?(in use|taken)`), "A VM with this vm_name already exists on the host, choose another vm_name"},
+	{regexp.MustCompile(`(?i)no space left|insufficient (disk )?space|not enough space|datastore .* full|out of disk`), "The datastore is full, ask an admin to free space or pick another host"},
+	{regexp.MustCompile(`(?i)ovftool|ovf_source|(failed|unable) to (download|open)`), "The OS image could not be downloaded or imported, check the image with /images or ask an admin"},
+	{regexp.MustCompile(`(?i)cannot complete login|incorrect user name or password|ssh: unable to authenticate|\bunauthorized\b|\b401\b`), "The ESXi credentials were rejected, please ask an admin"},
+	{regexp.MustCompile(`(?i)(ip|ip address).*(timeout|timed out)|(timeout|timed out).*(ip|ip address)|failed to get ip|guest_startup_timeout`), "The VM did not report an IP address in time, it may still be booting or its network is misconfigured"},
+	{regexp.MustCompile(`(?i)context deadline exceeded|signal: killed`), "Terraform did not finish within the time limit"},
+}
+
+// Cause classifies the failure, it returns an empty string for unknown causes
+func (e *TerraformError) Cause() string {
+	texts := []string{e.Err.Error()}
+	for _, d := range e.Diagnostics {
+		texts = append(texts, d.Summary+"\n"+d.Detail)
+	}
+	for _, c := range failureCauses {
+		for _, text := range texts {
+			if c.pattern.MatchString(text) {
+				return c.cause
+			}
+		}
+	}
+	return ""
+}
+
+// Diagnosis is a short explanation of the failure for the thread
+func (e *TerraformError) Diagnosis() string {
+	var b strings.Builder
+	if cause := e.Cause(); cause != "" {
+		b.WriteString(cause + "\n")
+	}
+	if len(e.Diagnostics) == 0 {
+		fmt.Fprintf(&b, "terraform %s failed: %v", e.Command, e.Err)
+		return b.String()
+	}
+	for _, d := range e.Diagnostics {
+		fmt.Fprintf(&b, "Error: %s", d.Summary)
+		if d.Address != "" {
+			fmt.Fprintf(&b, " (%s)", d.Address)
+		}
+		if detail := strings.TrimSpace(d.Detail); detail != "" {
+			// Cut whole characters, the detail may be in any language
+			if runes := []rune(detail); len(runes) > maxDiagnosticDetail {
+				detail = string(runes[:maxDiagnosticDetail]) + "..."
+			}
+			b.WriteString("\n" + detail)
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// terraformCapture records the output of a Terraform command with secrets
+// redacted and collects its error diagnostics, from -json messages or from
+// the "Error:" blocks of the human-readable output
+type terraformCapture struct {
+	redact *strings.Replacer
+
+	lock  sync.Mutex
+	log   bytes.Buffer
+	diags []tfrunner.Diagnostic
+	// block is the human-readable error block being read, if any
+	block *tfrunner.Diagnostic
+}
+
+// newTerraformCapture returns a capture redacting the values of the secret
+// TF_VAR_ variables in env
+func newTerraformCapture(env []string) *terraformCapture {
+	var pairs []string
+	for _, kv := range env {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || value == "" {
+			continue
+		}
+		if key, ok := strings.CutPrefix(name, "TF_VAR_"); ok && slices.Contains(secretVars, key) {
+			pairs = append(pairs, value, "[REDACTED "+key+"]")
+		}
+	}
+	return &terraformCapture{redact: strings.NewReplacer(pairs...)}
+}
+
+var boxPattern = regexp.MustCompile(`^[│╷╵]\s?`)
+
+// Handle records an event of the command
+func (c *terraformCapture) Handle(ev tfrunner.Event) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// -json messages are logged as their human-readable text
+	if ev.Type != tfrunner.EventText {
+		fmt.Fprintf(&c.log, "[%s] %s\n", ev.Level, c.redact.Replace(ev.Message))
+		if d := ev.Diagnostic; d != nil {
+			d.Summary = c.redact.Replace(d.Summary)
+			d.Detail = c.redact.Replace(d.Detail)
+			if d.Detail != "" {
+				c.log.WriteString(d.Detail + "\n")
+			}
+			if d.Severity == "error" {
+				c.diags = append(c.diags, *d)
+			}
+		}
+		return
+	}
+
+	line := c.redact.Replace(ansiPattern.ReplaceAllString(ev.Message, ""))
+	c.log.WriteString(line + "\n")
+	text := boxPattern.ReplaceAllString(line, "")
+	switch {
+	case strings.HasPrefix(text, "Error: "):
+		c.endBlock()
+		c.block = &tfrunner.Diagnostic{Severity: "error", Summary: strings.TrimPrefix(text, "Error: ")}
+	case c.block != nil && strings.HasPrefix(strings.TrimSpace(line), "╵"):
+		c.endBlock()
+	case c.block != nil:
+		c.block.Detail += text + "\n"
+	}
+}
+
+// endBlock stores the error block being read. Caller must hold the lock.
+func (c *terraformCapture) endBlock() {
+	if c.block != nil {
+		c.block.Detail = strings.TrimSpace(c.block.Detail)
+		c.diags = append(c.diags, *c.block)
+		c.block = nil
+	}
+}
+
+// Error wraps the error of the command with what was captured
+func (c *terraformCapture) Error(command string, err error) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.endBlock()
+	return &TerraformError{
+		Command:     command,
+		Err:         err,
+		Diagnostics: c.diags,
+		Log:         append([]byte(nil), c.log.Bytes()...),
+	}
+}
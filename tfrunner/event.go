@@ -0,0 +1,118 @@
+package tfrunner
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// EventType is the type of a machine-readable UI message
+type EventType string
+
+const (
+	EventVersion        EventType = "version"
+	EventLog            EventType = "log"
+	EventDiagnostic     EventType = "diagnostic"
+	EventPlannedChange  EventType = "planned_change"
+	EventChangeSummary  EventType = "change_summary"
+	EventOutputs        EventType = "outputs"
+	EventApplyStart     EventType = "apply_start"
+	EventApplyProgress  EventType = "apply_progress"
+	EventApplyComplete  EventType = "apply_complete"
+	EventApplyErrored   EventType = "apply_errored"
+	EventRefreshStart   EventType = "refresh_start"
+	EventRefreshDone    EventType = "refresh_complete"
+	EventResourceDrift  EventType = "resource_drift"
+	EventProvisionStart EventType = "provision_start"
+	// EventText is a line that is not a JSON message, such as the output of
+	// init or anything Terraform writes to stderr
+	EventText EventType = "text"
+)
+
+// Event is one message of Terraform's -json output
+type Event struct {
+	Level     string    `json:"@level"`
+	Message   string    `json:"@message"`
+	Module    string    `json:"@module"`
+	Timestamp time.Time `json:"@timestamp"`
+	Type      EventType `json:"type"`
+
+	Hook       *Hook             `json:"hook,omitempty"`
+	Change     *Change           `json:"change,omitempty"`
+	Changes    *Changes          `json:"changes,omitempty"`
+	Diagnostic *Diagnostic       `json:"diagnostic,omitempty"`
+	Outputs    map[string]Output `json:"outputs,omitempty"`
+	// Stderr marks EventText lines read from stderr
+	Stderr bool `json:"-"`
+}
+
+// Resource identifies a resource instance
+type Resource struct {
+	Addr            string `json:"addr"`
+	Module          string `json:"module"`
+	Resource        string `json:"resource"`
+	ResourceType    string `json:"resource_type"`
+	ResourceName    string `json:"resource_name"`
+	ImpliedProvider string `json:"implied_provider"`
+}
+
+// Hook is the payload of apply_*, refresh_* and provision_* events
+type Hook struct {
+	Resource       Resource `json:"resource"`
+	Action         string   `json:"action"`
+	IDKey          string   `json:"id_key"`
+	IDValue        string   `json:"id_value"`
+	ElapsedSeconds int      `json:"elapsed_seconds"`
+}
+
+// Elapsed is the time spent on the resource so far
+func (h *Hook) Elapsed() time.Duration {
+	return time.Duration(h.ElapsedSeconds) * time.Second
+}
+
+// Change is the payload of planned_change and resource_drift events
+type Change struct {
+	Resource Resource `json:"resource"`
+	Action   string   `json:"action"`
+	Reason   string   `json:"reason"`
+}
+
+// Changes is the payload of change_summary events
+type Changes struct {
+	Add       int    `json:"add"`
+	Change    int    `json:"change"`
+	Remove    int    `json:"remove"`
+	Operation string `json:"operation"`
+}
+
+// Diagnostic is a warning or error reported by Terraform
+type Diagnostic struct {
+	Severity string `json:"severity"`
+	Summary  string `json:"summary"`
+	Detail   string `json:"detail"`
+	Address  string `json:"address"`
+	Range    *struct {
+		Filename string `json:"filename"`
+		Start    struct {
+			Line   int `json:"line"`
+			Column int `json:"column"`
+		} `json:"start"`
+	} `json:"range,omitempty"`
+}
+
+// Output is a root module output, in outputs events and `terraform output -json`
+type Output struct {
+	Sensitive bool            `json:"sensitive"`
+	Type      json.RawMessage `json:"type,omitempty"`
+	Value     json.RawMessage `json:"value,omitempty"`
+	Action    string          `json:"action,omitempty"`
+}
+
+// ParseEvent decodes a line of output. Lines that are not JSON messages
+// become EventText events carrying the line as their message.
+func ParseEvent(line []byte) Event {
+	var ev Event
+	if len(line) > 0 && line[0] == '{' && json.Unmarshal(line, &ev) == nil && ev.Type != "" {
+		return ev
+	}
+	return Event{Level: "info", Message: string(line), Type: EventText}
+}
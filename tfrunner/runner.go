@@ -0,0 +1,142 @@
+// Package tfrunner runs Terraform commands and decodes their -json output
+// into typed events, so the bot, its logs and metrics consume the same stream.
+package tfrunner
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// maxLineSize bounds a single line of output, diagnostics can be long
+const maxLineSize = 1024 * 1024
+
+// Commands that accept -json and stream machine-readable UI messages
+var jsonCommands = map[string]bool{
+	"plan":    true,
+	"apply":   true,
+	"destroy": true,
+	"refresh": true,
+}
+
+// Runner runs Terraform in a working directory
+type Runner struct {
+	// Binary is the Terraform executable, "terraform" from PATH if empty
+	Binary string
+	// Dir is the working directory
+	Dir string
+	// Env is added to the environment of the current process
+	Env []string
+}
+
+// Run is a started Terraform command
+type Run struct {
+	// Events receives the events of stdout and stderr, it is closed when
+	// the command exits. It must be drained.
+	Events <-chan Event
+
+	cmd  *exec.Cmd
+	done chan struct{}
+	err  error
+}
+
+// Wait waits for the command to exit and returns its error
+func (r *Run) Wait() error {
+	<-r.done
+	return r.err
+}
+
+// Start starts a Terraform command, adding -json for commands that support it
+func (r *Runner) Start(ctx context.Context, command string, args ...string) (*Run, error) {
+	if jsonCommands[command] {
+		args = append([]string{"-json"}, args...)
+	}
+	cmd := r.command(ctx, command, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start terraform %s: %w", command, err)
+	}
+
+	events := make(chan Event, 64)
+	run := &Run{Events: events, cmd: cmd, done: make(chan struct{})}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go scan(stdout, false, events, &wg)
+	go scan(stderr, true, events, &wg)
+	go func() {
+		// Wait closes the pipes, so the readers must finish first
+		wg.Wait()
+		close(events)
+		run.err = cmd.Wait()
+		close(run.done)
+	}()
+	return run, nil
+}
+
+// Run runs a Terraform command, passing every event to handle, and returns
+// the error of the command
+func (r *Runner) Run(ctx context.Context, handle func(Event), command string, args ...string) error {
+	run, err := r.Start(ctx, command, args...)
+	if err != nil {
+		return err
+	}
+	for ev := range run.Events {
+		if handle != nil {
+			handle(ev)
+		}
+	}
+	return run.Wait()
+}
+
+// Outputs returns the root module outputs of the state
+func (r *Runner) Outputs(ctx context.Context) (map[string]Output, error) {
+	out, err := r.command(ctx, "output", "-json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute terraform output: %w", err)
+	}
+	var outputs map[string]Output
+	if err := json.Unmarshal(out, &outputs); err != nil {
+		return nil, fmt.Errorf("failed to parse terraform output JSON: %w", err)
+	}
+	return outputs, nil
+}
+
+func (r *Runner) command(ctx context.Context, command string, args ...string) *exec.Cmd {
+	binary := r.Binary
+	if binary == "" {
+		binary = "terraform"
+	}
+	cmd := exec.CommandContext(ctx, binary, append([]string{command}, args...)...)
+	cmd.Dir = r.Dir
+	cmd.Env = append(os.Environ(), r.Env...)
+	return cmd
+}
+
+// scan turns the lines of a stream into events
+func scan(r io.Reader, stderr bool, events chan<- Event, wg *sync.WaitGroup) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		ev := ParseEvent(scanner.Bytes())
+		if ev.Type == EventText && stderr {
+			ev.Level = "error"
+			ev.Stderr = true
+		}
+		events <- ev
+	}
+	// Drain the rest so the command never blocks on a full pipe
+	io.Copy(io.Discard, r)
+}
@@ -0,0 +1,219 @@
+package tfrunner
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// fakeTerraform replays the recorded output in testdata for each command.
+// destroy fails with a diagnostic on stdout and a plain error on stderr.
+const fakeTerraform = `#!/bin/sh
+case "$1" in
+init)
+	echo "Initializing the backend..."
+	echo "Terraform has been successfully initialized!"
+	;;
+plan|apply)
+	[ "$2" = "-json" ] || { echo "missing -json" >&2; exit 2; }
+	cat "$FIXTURES/$1.jsonl"
+	;;
+destroy)
+	cat "$FIXTURES/apply_error.jsonl"
+	echo "Error: connection refused" >&2
+	exit 1
+	;;
+output)
+	cat "$FIXTURES/output.json"
+	;;
+*)
+	echo "unknown command $1" >&2
+	exit 2
+	;;
+esac
+`
+
+func newFakeRunner(t *testing.T) *Runner {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake terraform binary is a shell script")
+	}
+	fixtures, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := filepath.Join(t.TempDir(), "terraform")
+	if err := os.WriteFile(binary, []byte(fakeTerraform), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &Runner{Binary: binary, Dir: t.TempDir(), Env: []string{"FIXTURES=" + fixtures}}
+}
+
+func collect(t *testing.T, r *Runner, command string, args ...string) ([]Event, error) {
+	t.Helper()
+	var events []Event
+	err := r.Run(context.Background(), func(ev Event) { events = append(events, ev) }, command, args...)
+	return events, err
+}
+
+func eventTypes(events []Event) []EventType {
+	var types []EventType
+	for _, ev := range events {
+		types = append(types, ev.Type)
+	}
+	return types
+}
+
+func TestParseEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want Event
+	}{
+		{
+			name: "json message",
+			line: `{"@level":"info","@message":"Plan: 1 to add, 0 to change, 0 to destroy.","@module":"terraform.ui","changes":{"add":1,"change":0,"remove":0,"operation":"plan"},"type":"change_summary"}`,
+			want: Event{Level: "info", Message: "Plan: 1 to add, 0 to change, 0 to destroy.", Module: "terraform.ui", Type: EventChangeSummary,
+				Changes: &Changes{Add: 1, Operation: "plan"}},
+		},
+		{
+			name: "text",
+			line: "Initializing provider plugins...",
+			want: Event{Level: "info", Message: "Initializing provider plugins...", Type: EventText},
+		},
+		{
+			name: "invalid json",
+			line: `{"type": "apply_start"`,
+			want: Event{Level: "info", Message: `{"type": "apply_start"`, Type: EventText},
+		},
+		{
+			name: "json without type",
+			line: `{"foo":"bar"}`,
+			want: Event{Level: "info", Message: `{"foo":"bar"}`, Type: EventText},
+		},
+		{
+			name: "empty line",
+			line: "",
+			want: Event{Level: "info", Type: EventText},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseEvent([]byte(tt.line)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseEvent() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunPlan(t *testing.T) {
+	events, err := collect(t, newFakeRunner(t), "plan", "-input=false", "-out=plan.bin")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	want := []EventType{EventVersion, EventPlannedChange, EventChangeSummary}
+	if got := eventTypes(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("event types = %v, want %v", got, want)
+	}
+	change := events[1].Change
+	if change == nil || change.Resource.Addr != "esxi_guest.vm" || change.Action != "create" {
+		t.Errorf("planned change = %+v, want create of esxi_guest.vm", change)
+	}
+	if c := events[2].Changes; c == nil || c.Add != 1 || c.Operation != "plan" {
+		t.Errorf("change summary = %+v, want 1 to add", c)
+	}
+}
+
+func TestRunApply(t *testing.T) {
+	events, err := collect(t, newFakeRunner(t), "apply", "-input=false", "plan.bin")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	want := []EventType{EventVersion, EventApplyStart, EventApplyProgress, EventApplyComplete, EventChangeSummary, EventOutputs}
+	if got := eventTypes(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("event types = %v, want %v", got, want)
+	}
+	if hook := events[2].Hook; hook == nil || hook.Elapsed().Seconds() != 10 {
+		t.Errorf("apply_progress hook = %+v, want 10s elapsed", hook)
+	}
+	if hook := events[3].Hook; hook == nil || hook.IDValue != "42" {
+		t.Errorf("apply_complete hook = %+v, want id 42", hook)
+	}
+	if ip, ok := events[5].Outputs["ip"]; !ok || string(ip.Value) != `["10.0.0.12"]` {
+		t.Errorf("outputs = %+v, want ip 10.0.0.12", events[5].Outputs)
+	}
+}
+
+func TestRunText(t *testing.T) {
+	events, err := collect(t, newFakeRunner(t), "init")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	for _, ev := range events {
+		if ev.Type != EventText || ev.Stderr || ev.Level != "info" {
+			t.Errorf("event = %+v, want info text from stdout", ev)
+		}
+	}
+	if events[0].Message != "Initializing the backend..." {
+		t.Errorf("message = %q, want the first line of init", events[0].Message)
+	}
+}
+
+func TestRunStderr(t *testing.T) {
+	events, err := collect(t, newFakeRunner(t), "destroy", "-auto-approve")
+	if err == nil {
+		t.Fatal("Run() error = nil, want the exit status")
+	}
+	var diag *Diagnostic
+	var stderr []Event
+	for _, ev := range events {
+		if ev.Type == EventDiagnostic {
+			diag = ev.Diagnostic
+		}
+		if ev.Stderr {
+			stderr = append(stderr, ev)
+		}
+	}
+	if diag == nil || diag.Summary != "Failed to connect to ESXi host" || diag.Range == nil || diag.Range.Start.Line != 12 {
+		t.Errorf("diagnostic = %+v, want the recorded connection error", diag)
+	}
+	if len(stderr) != 1 {
+		t.Fatalf("got %d stderr events, want 1", len(stderr))
+	}
+	if ev := stderr[0]; ev.Type != EventText || ev.Level != "error" || ev.Message != "Error: connection refused" {
+		t.Errorf("stderr event = %+v, want an error text event", ev)
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	outputs, err := newFakeRunner(t).Outputs(context.Background())
+	if err != nil {
+		t.Fatalf("Outputs() error = %v", err)
+	}
+	ip, ok := outputs["ip"]
+	if !ok {
+		t.Fatalf("outputs = %v, want ip", outputs)
+	}
+	var ips []string
+	if err := json.Unmarshal(ip.Value, &ips); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ips, []string{"10.0.0.12"}) || ip.Sensitive {
+		t.Errorf("ip = %v (sensitive %v), want [10.0.0.12]", ips, ip.Sensitive)
+	}
+}
+
+func TestOutputsError(t *testing.T) {
+	r := newFakeRunner(t)
+	r.Binary = filepath.Join(t.TempDir(), "missing")
+	if _, err := r.Outputs(context.Background()); err == nil {
+		t.Error("Outputs() error = nil, want an error for a missing binary")
+	}
+}
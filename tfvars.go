@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// VarType is a Terraform type constraint as declared in variable.tf
+type VarType struct {
+	// Kind is string, number, bool, any, list, set, map, tuple or object
+	Kind string
+	// Elem is the element type of list, set and map
+	Elem *VarType
+	// Attrs are the attribute types of object
+	Attrs map[string]*VarType
+}
+
+func (t *VarType) String() string {
+	switch t.Kind {
+	case "list", "set", "map":
+		return fmt.Sprintf("%s(%s)", t.Kind, t.Elem)
+	case "object":
+		names := sortedKeys(t.Attrs)
+		attrs := make([]string, len(names))
+		for i, name := range names {
+			attrs[i] = fmt.Sprintf("%s=%s", name, t.Attrs[name])
+		}
+		return fmt.Sprintf("object({%s})", strings.Join(attrs, ","))
+	}
+	return t.Kind
+}
+
+var (
+	variableBlockPattern = regexp.MustCompile(`^\s*variable\s+"([^"]+)"\s*\{`)
+	typeAttrPattern      = regexp.MustCompile(`^\s*type\s*=\s*(.*)$`)
+	identifierPattern    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+)
+
+// loadVariableTypes reads the type constraint of every variable declared in
+// a variable.tf file. Variables without a type constraint get type any.
+func loadVariableTypes(path string) (map[string]*VarType, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	types := make(map[string]*VarType)
+	var current, expr string
+	depth := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Continue a type expression spanning several lines
+		if expr != "" {
+			expr += " " + line
+			depth += bracketDepth(line)
+			if depth <= 0 {
+				if err := addVariableType(types, current, expr); err != nil {
+					return nil, err
+				}
+				expr = ""
+			}
+			continue
+		}
+		if m := variableBlockPattern.FindStringSubmatch(line); m != nil {
+			current = m[1]
+			types[current] = &VarType{Kind: "any"}
+			continue
+		}
+		if m := typeAttrPattern.FindStringSubmatch(line); m != nil && current != "" {
+			depth = bracketDepth(m[1])
+			if depth > 0 {
+				expr = m[1]
+				continue
+			}
+			if err := addVariableType(types, current, m[1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return types, nil
+}
+
+func addVariableType(types map[string]*VarType, name, expr string) error {
+	t, err := parseVarType(expr)
+	if err != nil {
+		return fmt.Errorf("variable %q: %w", name, err)
+	}
+	types[name] = t
+	return nil
+}
+
+// bracketDepth returns the number of unclosed brackets in s
+func bracketDepth(s string) int {
+	depth := 0
+	for _, r := range s {
+		switch r {
+		case '(', '{', '[':
+			depth++
+		case ')', '}', ']':
+			depth--
+		}
+	}
+	return depth
+}
+
+// parseVarType parses a type constraint such as list(object({name=string}))
+func parseVarType(expr string) (*VarType, error) {
+	p := &typeParser{src: expr}
+	t, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos != len(p.src) {
+		return nil, fmt.Errorf("unexpected %q in type %q", p.src[p.pos:], expr)
+	}
+	return t, nil
+}
+
+type typeParser struct {
+	src string
+	pos int
+}
+
+func (p *typeParser) skipSpace() {
+	for p.pos < len(p.src) && (unicode.IsSpace(rune(p.src[p.pos])) || p.src[p.pos] == ',') {
+		p.pos++
+	}
+}
+
+func (p *typeParser) ident() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.src) && (p.src[p.pos] == '_' || unicode.IsLetter(rune(p.src[p.pos])) || unicode.IsDigit(rune(p.src[p.pos]))) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *typeParser) expect(c byte) error {
+	p.skipSpace()
+	if p.pos >= len(p.src) || p.src[p.pos] != c {
+		return fmt.Errorf("expected %q in type %q", c, p.src)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *typeParser) peek(c byte) bool {
+	p.skipSpace()
+	return p.pos < len(p.src) && p.src[p.pos] == c
+}
+
+func (p *typeParser) parse() (*VarType, error) {
+	kind := p.ident()
+	switch kind {
+	case "string", "number", "bool", "any":
+		return &VarType{Kind: kind}, nil
+	case "list", "set", "map":
+		if err := p.expect('('); err != nil {
+			return nil, err
+		}
+		elem, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(')'); err != nil {
+			return nil, err
+		}
+		return &VarType{Kind: kind, Elem: elem}, nil
+	case "object":
+		if err := p.expect('('); err != nil {
+			return nil, err
+		}
+		if err := p.expect('{'); err != nil {
+			return nil, err
+		}
+		t := &VarType{Kind: kind, Attrs: make(map[string]*VarType)}
+		for !p.peek('}') {
+			name := p.ident()
+			if name == "" {
+				return nil, fmt.Errorf("expected attribute name in type %q", p.src)
+			}
+			if err := p.expect('='); err != nil {
+				return nil, err
+			}
+			attr, err := p.parse()
+			if err != nil {
+				return nil, err
+			}
+			t.Attrs[name] = attr
+		}
+		p.pos++
+		if err := p.expect(')'); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("unsupported type %q in %q", kind, p.src)
+}
+
+// writeTfVarsFile writes variable values to a terraform.tfvars file. Values
+// are encoded according to the types declared in varsFile, keys are sorted.
+func writeTfVarsFile(path, varsFile string, vars map[string]interface{}) error {
+	types, err := loadVariableTypes(varsFile)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	for _, key := range sortedKeys(vars) {
+		t, ok := types[key]
+		if !ok {
+			return fmt.Errorf("variable %q is not declared in %s", key, varsFile)
+		}
+		value, err := encodeHCL(vars[key], t)
+		if err != nil {
+			return fmt.Errorf("variable %q: %w", key, err)
+		}
+		fmt.Fprintf(&b, "%s = %s\n", key, value)
+	}
+
+	if err := os.WriteFile(path, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("failed to write terraform.tfvars: %w", err)
+	}
+	return nil
+}
+
+// encodeHCL renders a Go value as an HCL expression of type t
+func encodeHCL(value interface{}, t *VarType) (string, error) {
+	v := reflect.ValueOf(value)
+	switch t.Kind {
+	case "string":
+		if v.Kind() != reflect.String {
+			return "", fmt.Errorf("expected string, got %T", value)
+		}
+		return quoteHCL(v.String()), nil
+	case "number":
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return strconv.FormatInt(v.Int(), 10), nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return strconv.FormatUint(v.Uint(), 10), nil
+		case reflect.Float32, reflect.Float64:
+			return strconv.FormatFloat(v.Float(), 'g', -1, 64), nil
+		case reflect.String:
+			if _, err := strconv.ParseFloat(v.String(), 64); err != nil {
+				return "", fmt.Errorf("%q is not a number", v.String())
+			}
+			return v.String(), nil
+		}
+		return "", fmt.Errorf("expected number, got %T", value)
+	case "bool":
+		switch v.Kind() {
+		case reflect.Bool:
+			return strconv.FormatBool(v.Bool()), nil
+		case reflect.String:
+			b, err := strconv.ParseBool(v.String())
+			if err != nil {
+				return "", fmt.Errorf("%q is not a bool", v.String())
+			}
+			return strconv.FormatBool(b), nil
+		}
+		return "", fmt.Errorf("expected bool, got %T", value)
+	case "list", "set":
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			return "", fmt.Errorf("expected %s, got %T", t, value)
+		}
+		items := make([]string, v.Len())
+		for i := range items {
+			item, err := encodeHCL(v.Index(i).Interface(), t.Elem)
+			if err != nil {
+				return "", fmt.Errorf("element %d: %w", i, err)
+			}
+			items[i] = item
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case "map":
+		return encodeHCLObject(v, func(string) *VarType { return t.Elem }, t)
+	case "object":
+		// Structs are encoded through their tfvar tags
+		if v.Kind() == reflect.Pointer {
+			v = v.Elem()
+		}
+		if v.Kind() == reflect.Struct {
+			v = reflect.ValueOf(structVars(v))
+		}
+		return encodeHCLObject(v, func(name string) *VarType { return t.Attrs[name] }, t)
+	case "any":
+		return encodeHCLAny(value)
+	}
+	return "", fmt.Errorf("unsupported type %s", t)
+}
+
+// encodeHCLObject renders a Go map as an HCL object with sorted keys
+func encodeHCLObject(v reflect.Value, attrType func(string) *VarType, t *VarType) (string, error) {
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return "", fmt.Errorf("expected %s, got %s", t, v.Type())
+	}
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+
+	attrs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		at := attrType(key)
+		if at == nil {
+			return "", fmt.Errorf("unexpected attribute %q for %s", key, t)
+		}
+		item, err := encodeHCL(v.MapIndex(reflect.ValueOf(key)).Interface(), at)
+		if err != nil {
+			return "", fmt.Errorf("attribute %q: %w", key, err)
+		}
+		name := key
+		if !identifierPattern.MatchString(name) {
+			name = quoteHCL(name)
+		}
+		attrs = append(attrs, fmt.Sprintf("%s = %s", name, item))
+	}
+	return "{ " + strings.Join(attrs, ", ") + " }", nil
+}
+
+// structVars returns the tfvar-tagged fields of a struct keyed by variable name
+func structVars(v reflect.Value) map[string]interface{} {
+	vars := make(map[string]interface{})
+	for key, i := range tfvarFields(v.Type()) {
+		vars[key] = v.Field(i).Interface()
+	}
+	return vars
+}
+
+// encodeHCLAny renders a value of an untyped variable from its Go type
+func encodeHCLAny(value interface{}) (string, error) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String:
+		return encodeHCL(value, &VarType{Kind: "string"})
+	case reflect.Bool:
+		return encodeHCL(value, &VarType{Kind: "bool"})
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return encodeHCL(value, &VarType{Kind: "number"})
+	case reflect.Slice, reflect.Array:
+		return encodeHCL(value, &VarType{Kind: "list", Elem: &VarType{Kind: "any"}})
+	case reflect.Map:
+		return encodeHCL(value, &VarType{Kind: "map", Elem: &VarType{Kind: "any"}})
+	}
+	return "", fmt.Errorf("unsupported value of type %T", value)
+}
+
+// quoteHCL renders s as a quoted HCL string. Template sequences are escaped
+// so the value is always taken literally.
+func quoteHCL(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '"':
+			b.WriteString(`\"`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case (r == '$' || r == '%') && strings.HasPrefix(s[i+1:], "{"):
+			// ${ and %{ start template sequences, they are escaped by doubling
+			b.WriteRune(r)
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// sortedKeys returns the keys of a string-keyed map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
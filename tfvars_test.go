@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQuoteHCL(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "plain", in: "ubuntu", want: `"ubuntu"`},
+		{name: "interpolation", in: "${var.esxi_password}", want: `"$${var.esxi_password}"`},
+		{name: "directive", in: "%{ if true }x%{ endif }", want: `"%%{ if true }x%%{ endif }"`},
+		{name: "escaped interpolation", in: "$${x}", want: `"$$${x}"`},
+		{name: "lone dollar and percent", in: "$5 is 100% {ok}", want: `"$5 is 100% {ok}"`},
+		{name: "sequence at the end", in: "a${", want: `"a$${"`},
+		{name: "quotes", in: `say "hi"`, want: `"say \"hi\""`},
+		{name: "backslash", in: `C:\temp\`, want: `"C:\\temp\\"`},
+		{name: "quote breakout", in: "x\"\nesxi_hostname = \"evil", want: `"x\"\nesxi_hostname = \"evil"`},
+		{name: "whitespace controls", in: "a\tb\r\nc", want: `"a\tb\r\nc"`},
+		{name: "other controls", in: "a\x00b\x1bc\x7f", want: `"a\u0000b\u001bc\u007f"`},
+		{name: "unicode", in: "虚拟机 ✓", want: `"虚拟机 ✓"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quoteHCL(tt.in); got != tt.want {
+				t.Errorf("quoteHCL(%q) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVarType(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    string
+		wantErr bool
+	}{
+		{expr: "string", want: "string"},
+		{expr: " number ", want: "number"},
+		{expr: "list(string)", want: "list(string)"},
+		{expr: "map(list(bool))", want: "map(list(bool))"},
+		{expr: "object({ b = number, a = string })", want: "object({a=string,b=number})"},
+		{expr: "list(object({\n  name = string\n  sudo = bool\n  ssh_public_keys = list(string)\n}))", want: "list(object({name=string,ssh_public_keys=list(string),sudo=bool}))"},
+		{expr: "tuple([string])", wantErr: true},
+		{expr: "list(string", wantErr: true},
+		{expr: "object({ = string })", wantErr: true},
+		{expr: "string string", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := parseVarType(tt.expr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseVarType(%q) = %s, want an error", tt.expr, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseVarType(%q) error = %v", tt.expr, err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("parseVarType(%q) = %s, want %s", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadVariableTypes(t *testing.T) {
+	types, err := loadVariableTypes("terraform/variable.tf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"vm_name":         "string",
+		"numvcpus":        "number",
+		"ssh_public_keys": "list(string)",
+		"extra_users":     "list(object({name=string,ssh_public_keys=list(string),sudo=bool}))",
+		"cloud_config":    "string",
+	}
+	for name, typ := range want {
+		if got, ok := types[name]; !ok || got.String() != typ {
+			t.Errorf("type of %s = %v, want %s", name, got, typ)
+		}
+	}
+}
+
+func TestEncodeHCL(t *testing.T) {
+	extraUsers, err := parseVarType("list(object({name=string, sudo=bool, ssh_public_keys=list(string)}))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		value   interface{}
+		typ     *VarType
+		want    string
+		wantErr bool
+	}{
+		{name: "string", value: "${file(\"/etc/shadow\")}", typ: &VarType{Kind: "string"}, want: `"$${file(\"/etc/shadow\")}"`},
+		{name: "number", value: 2048, typ: &VarType{Kind: "number"}, want: "2048"},
+		{name: "number from string", value: "1.5", typ: &VarType{Kind: "number"}, want: "1.5"},
+		{name: "expression as number", value: "1 + var.x", typ: &VarType{Kind: "number"}, wantErr: true},
+		{name: "bool", value: "true", typ: &VarType{Kind: "bool"}, want: "true"},
+		{name: "string as bool", value: "yes", typ: &VarType{Kind: "bool"}, wantErr: true},
+		{name: "list", value: []string{"a", "${b}"}, typ: &VarType{Kind: "list", Elem: &VarType{Kind: "string"}}, want: `["a", "$${b}"]`},
+		{name: "string as list", value: "a", typ: &VarType{Kind: "list", Elem: &VarType{Kind: "string"}}, wantErr: true},
+		{name: "map keys sorted and quoted", value: map[string]string{"b": "2", "a key": "1"}, typ: &VarType{Kind: "map", Elem: &VarType{Kind: "string"}},
+			want: `{ "a key" = "1", b = "2" }`},
+		{name: "list of objects", value: []ExtraUser{{Name: "bob", Sudo: true, SSHPublicKeys: []string{"ssh-ed25519 AAAA bob"}}}, typ: extraUsers,
+			want: `[{ name = "bob", ssh_public_keys = ["ssh-ed25519 AAAA bob"], sudo = true }]`},
+		{name: "unknown attribute", value: map[string]string{"shell": "/bin/sh"}, typ: &VarType{Kind: "object", Attrs: map[string]*VarType{"name": {Kind: "string"}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encodeHCL(tt.value, tt.typ)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("encodeHCL() = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("encodeHCL() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("encodeHCL() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteTfVarsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "terraform.tfvars")
+	vars := map[string]interface{}{
+		"vm_name":         "web\"\nesxi_hostname = \"evil",
+		"numvcpus":        2,
+		"ssh_public_keys": []string{"ssh-ed25519 AAAA a"},
+		"cloud_config":    "runcmd:\n  - echo ${HOME}\n",
+		"disk_type":       "thin",
+	}
+	if err := writeTfVarsFile(path, "terraform/variable.tf", vars); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		`cloud_config = "runcmd:\n  - echo $${HOME}\n"`,
+		`disk_type = "thin"`,
+		`numvcpus = 2`,
+		`ssh_public_keys = ["ssh-ed25519 AAAA a"]`,
+		`vm_name = "web\"\nesxi_hostname = \"evil"`,
+	}, "\n") + "\n"
+	if string(data) != want {
+		t.Errorf("terraform.tfvars =\n%s\nwant\n%s", data, want)
+	}
+
+	if err := writeTfVarsFile(path, "terraform/variable.tf", map[string]interface{}{"undeclared": "x"}); err == nil {
+		t.Error("writeTfVarsFile() accepted an undeclared variable")
+	}
+}